@@ -1,80 +1,568 @@
 package eventsource
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrFlushNotSupported is returned when creating a client on a response
+	// writer that cannot be flushed
+	ErrFlushNotSupported = errors.New("eventsource: response writer does not support flushing")
+
+	// ErrClientClosed is returned by Send and the other sending methods when
+	// the client has been shut down or has disconnected
+	ErrClientClosed = errors.New("eventsource: client closed")
+
+	// ErrNilEvent is returned by Send and the other sending methods when given
+	// a nil event
+	ErrNilEvent = errors.New("eventsource: nil event")
+
+	// ErrWriteTimeout is returned by Send and passed to the error handler when
+	// the client has stalled, see Client.SetWriteTimeout
+	ErrWriteTimeout = errors.New("eventsource: client write timed out")
+
+	// ErrCloseNotifyNotSupported is returned when creating a client without a
+	// request on a response writer that does not support close notification
+	ErrCloseNotifyNotSupported = errors.New("eventsource: response writer does not support close notification")
 )
 
 // Client wraps an http connection and converts it to an
 // event stream.
 type Client struct {
-	flush  http.Flusher
-	write  io.Writer
-	close  http.CloseNotifier
-	events chan *Event
-	closed bool
-	waiter sync.WaitGroup
+	counters clientCounters
+	flush    func() error
+	write    io.Writer
+	gz       *gzip.Writer
+	closer   io.Closer
+	info     ConnInfo
+	created  time.Time
+	close    <-chan bool
+	gone     <-chan struct{}
+	cancel   <-chan struct{}
+	events   chan *Event
+	jobs     chan *clientJob
+	closed   bool
+	done     chan struct{}
+	quit     chan struct{}
+	stall    sync.Once
+	waiter   sync.WaitGroup
+	lock     sync.Mutex
+	onErr    func(error)
+	meta     map[string]interface{}
+	lastID   atomic.Value
+
+	// events queued with SendLatest, guarded by lock
+	latest     map[string]*Event
+	latestKeys []string
+	wake       chan struct{}
+
+	// events never written once the worker stopped, guarded by lock, and
+	// those the worker had already taken from the queue, only used by the
+	// worker
+	undelivered []*Event
+	unwritten   []*Event
+
+	// how long a write may take before the client is stalled, and whether the
+	// worker has exited so writes can no longer be interrupted, guarded by lock
+	writeTimeout time.Duration
+	exited       bool
+
+	// deadline for each write on the connection, guarded by lock
+	writeDeadline time.Duration
+	setDeadline   func(time.Time) error
+
+	// when events are flushed, guarded by lock, and the coalesced events
+	// not yet flushed, only used by the worker
+	flushMode      FlushMode
+	unflushed      int
+	unflushedSince time.Time
+
+	// keep-alive sent when idle, guarded by lock
+	keepAlive      time.Duration
+	keepAliveEvent *Event
+
+	// rate limiting, interval is guarded by lock and next is only used
+	// by the worker
+	interval  time.Duration
+	nextWrite time.Time
+
+	// guards closed and closing the events channel
+	sendLock sync.RWMutex
+
+	// the write error that stopped the worker, only used by the worker
+	failure error
 }
 
 // NewClient creates a client wrapping a response writer.
-// The response writer must support http.Flusher and http.CloseNotifier
-// interfaces.
+// The response writer must support the http.Flusher interface, either
+// directly or through middleware that can be unwrapped by
+// http.ResponseController.
 // When writing, the client will automatically send some headers. Passing the
 // original http.Request helps determine which headers, but the request it is
 // optional.
-// Returns nil on error.
+// If the request is given, its context is used to detect the client
+// disconnecting. Otherwise the response writer must also support the
+// http.CloseNotifier interface.
+// Returns nil on error, see NewClientError for the cause.
 func NewClient(w http.ResponseWriter, req *http.Request) *Client {
-	c := &Client{
-		events: make(chan *Event, 1),
-		write:  w,
+	c, err := NewClientError(w, req)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// NewClientError creates a client wrapping a response writer in the same
+// way as NewClient, but returns an error describing why the client could not
+// be created.
+func NewClientError(w http.ResponseWriter, req *http.Request) (*Client, error) {
+	return newClient(context.Background(), w, req, false, nil)
+}
+
+// NewClientGzip creates a client in the same way as NewClientError, but
+// compresses the stream with gzip if the request accepts it.
+// Every event is flushed through the compressor so latency is not affected.
+func NewClientGzip(w http.ResponseWriter, req *http.Request) (*Client, error) {
+	return newClient(context.Background(), w, req, req != nil && acceptsGzip(req), nil)
+}
+
+// NewClientContext creates a client in the same way as NewClientError, which
+// is shut down when the given context is done. This allows the client to be
+// stopped by code other than the handler waiting on it, for example on logout.
+// The context is independent of the request's, which is still used to detect
+// disconnects.
+func NewClientContext(ctx context.Context, w http.ResponseWriter, req *http.Request) (*Client, error) {
+	return newClient(ctx, w, req, false, nil)
+}
+
+// NewClientWrapped creates a client in the same way as NewClientError, but
+// writes through the writer returned by wrap, for example to tee the stream to
+// a log or trace writes. The wrapper is applied once, around the response
+// writer, so it sees exactly the bytes sent on the connection. Flushing still
+// targets the response writer directly.
+func NewClientWrapped(w http.ResponseWriter, req *http.Request, wrap func(io.Writer) io.Writer) (*Client, error) {
+	return newClient(context.Background(), w, req, false, wrap)
+}
+
+// Creates a client stopped by the context, optionally compressing the stream
+// and wrapping the response writer
+func newClient(ctx context.Context, w http.ResponseWriter, req *http.Request, compress bool, wrap func(io.Writer) io.Writer) (*Client, error) {
+	var out io.Writer = w
+	if wrap != nil {
+		out = wrap(w)
 	}
+	c := allocClient(out)
+	c.cancel = ctx.Done()
 
-	// Check to ensure we support flushing
-	flush, ok := w.(http.Flusher)
-	if !ok {
-		return nil
+	// Check to ensure we support flushing, looking through any middleware
+	// that wraps the response writer
+	if !canFlush(w) {
+		return nil, ErrFlushNotSupported
 	}
-	c.flush = flush
+	control := http.NewResponseController(w)
+	c.flush = control.Flush
+	c.setDeadline = control.SetWriteDeadline
 
-	// Check to ensure we support close notifications
-	closer, ok := w.(http.CloseNotifier)
-	if !ok {
-		return nil
+	// Detect disconnects through the request context where we can, as it
+	// works with every server including HTTP/2. Otherwise check to ensure we
+	// support close notifications
+	if req != nil {
+		c.gone = req.Context().Done()
+		c.info = connInfo(req)
+	} else {
+		closer, ok := w.(http.CloseNotifier)
+		if !ok {
+			return nil, ErrCloseNotifyNotSupported
+		}
+		c.close = closer.CloseNotify()
 	}
-	c.close = closer
 
 	// Send the initial headers
 	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
+	// keep caching directives already set that include no-cache, such as
+	// no-transform for proxies
+	if !strings.Contains(w.Header().Get("Cache-Control"), "no-cache") {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
 	if req == nil || req.ProtoMajor < 2 {
 		w.Header().Set("Connection", "keep-alive")
+	} else {
+		// connection specific headers are not allowed in HTTP/2
+		w.Header().Del("Connection")
 	}
-	flush.Flush()
 
-	// start the sending thread
+	// the stream has no length, which lets the server chunk the response on
+	// HTTP/1.1, so drop any length set by middleware
+	w.Header().Del("Content-Length")
+
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		c.gz = gzip.NewWriter(c.write)
+		c.write = c.gz
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	c.start()
+	return c, nil
+}
+
+// NewClientWriter creates a client that writes the event stream to a plain
+// writer, without any HTTP handling. This is mostly useful to capture the
+// events sent to a client in tests.
+// The writer is flushed after each event if it supports http.Flusher. The
+// client can not detect disconnects, and runs until it is shutdown or a write
+// fails.
+func NewClientWriter(w io.Writer) *Client {
+	c := allocClient(w)
+	if flush, ok := w.(http.Flusher); ok {
+		c.flush = func() error {
+			flush.Flush()
+			return nil
+		}
+	}
+
+	c.start()
+	return c
+}
+
+// Allocates a client writing to w that has not been started
+func allocClient(w io.Writer) *Client {
+	c := &Client{
+		events:  make(chan *Event, 1),
+		jobs:    make(chan *clientJob),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		quit:    make(chan struct{}),
+		created: time.Now(),
+	}
+
+	// count the bytes that reach the connection, after any compression
+	c.write = countWriter{w: w, n: &c.counters.bytes}
+	return c
+}
+
+// Starts the sending thread
+func (c *Client) start() {
 	c.waiter.Add(1)
 	go c.run()
-	return c
 }
 
 // Send queues an event to be sent to the client.
 // This does not block until the event has been sent.
 // Returns an error if the Client has disconnected
 func (c *Client) Send(ev *Event) error {
+	if ev == nil {
+		return ErrNilEvent
+	}
+	return c.send(ev.share())
+}
+
+// SendOwned queues an event to be sent to the client in the same way as Send,
+// but without copying it first. The client takes ownership of the event, which
+// must never be used again by the caller, not even to send to another client.
+func (c *Client) SendOwned(ev *Event) error {
+	if ev == nil {
+		return ErrNilEvent
+	}
+
+	// prepare the event now so the worker only ever reads it
+	ev.Bytes()
+	return c.send(ev)
+}
+
+// SendBatch queues several events to be sent to the client together.
+// The events are written in order with a single write and flush. Either all
+// of the events are queued or, if the Client has disconnected, none are and
+// an error is returned.
+func (c *Client) SendBatch(evs []*Event) error {
+	for _, ev := range evs {
+		if ev == nil {
+			return ErrNilEvent
+		}
+	}
+
+	batch := &Event{batch: true, batched: len(evs)}
+	for _, ev := range evs {
+		batch.WriteRaw(ev.Clone().Bytes())
+
+		// the id is not part of the raw wire format, it is only kept to
+		// track the last id written
+		if ev.id != "" {
+			batch.id = ev.id
+		}
+	}
+	return c.send(batch)
+}
+
+// send queues an event that has already been shared without copying it
+// again. Used by the stream to hand one prepared event to many clients.
+func (c *Client) send(ev *Event) error {
+	c.sendLock.RLock()
+	defer c.sendLock.RUnlock()
+
 	if c.closed {
-		return io.ErrClosedPipe
+		return ErrClientClosed
 	}
-	c.events <- ev.Clone()
-	return nil
+
+	// never queue to a client whose worker has stopped or stalled
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	case <-c.quit:
+		return ErrWriteTimeout
+	default:
+	}
+
+	select {
+	case c.events <- ev:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	case <-c.quit:
+		return ErrWriteTimeout
+	}
+}
+
+// SetWriteTimeout sets how long writing anything to the client, an event or
+// a keep-alive, may take before the client is considered stalled, such as a
+// client that connected but never reads. A stalled client is closed: the
+// error handler is called with ErrWriteTimeout, Send returns ErrWriteTimeout,
+// and the blocked write is interrupted so the worker stops and Wait returns.
+// Writes are interrupted through the connection's write deadline, see
+// SetWriteDeadline, or by closing connections from NewClientConn. Otherwise
+// the worker only stops once the write returns.
+// A timeout of 0 disables the check, which is the default.
+func (c *Client) SetWriteTimeout(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeTimeout = d
+}
+
+// Gives up on a client whose write has not completed within the write
+// timeout, interrupting the write if the connection allows it
+func (c *Client) stalled() {
+	c.stall.Do(func() {
+		close(c.quit)
+
+		// once the worker has exited the connection may belong to another
+		// response, so it must not be touched
+		c.lock.Lock()
+		if !c.exited {
+			if c.setDeadline != nil {
+				c.setDeadline(time.Now())
+			}
+			if c.closer != nil {
+				c.closer.Close()
+			}
+		}
+		c.lock.Unlock()
+
+		c.reportError(ErrWriteTimeout)
+	})
+}
+
+// Flush blocks until every event queued before the call has been written
+// and flushed to the client.
+// Returns an error if the Client has disconnected before that happens.
+func (c *Client) Flush() error {
+	return c.do(nil)
+}
+
+// SendReader sends an event whose data is streamed from r rather than held
+// in memory. The id, event type and retry fields are taken from ev, and its
+// data is ignored.
+// Every line read from r is sent as a data line, including empty ones. The
+// event is written after all previously queued events and this blocks until
+// it has been flushed.
+// If reading from r fails the event cannot be completed, so the client is
+// closed and the error returned.
+func (c *Client) SendReader(ev *Event, r io.Reader) error {
+	if ev == nil {
+		return ErrNilEvent
+	}
+	meta := ev.Clone()
+	meta.data = nil
+	return c.do(func() error {
+		return c.writeStream(meta, r)
+	})
+}
+
+// A unit of work run by the worker once all events queued ahead of it have
+// been written. Jobs have exclusive use of the writer.
+type clientJob struct {
+	run    func() error
+	result chan error
+}
+
+// Runs the function on the worker and waits for the result. A nil function
+// acts as a flush barrier.
+func (c *Client) do(fn func() error) error {
+	c.sendLock.RLock()
+	closed := c.closed
+	c.sendLock.RUnlock()
+	if closed {
+		return ErrClientClosed
+	}
+
+	job := &clientJob{
+		run:    fn,
+		result: make(chan error, 1),
+	}
+	select {
+	case c.jobs <- job:
+	case <-c.done:
+		return ErrClientClosed
+	}
+
+	select {
+	case err := <-job.result:
+		return err
+	case <-c.done:
+		// the job may have completed just before the worker stopped
+		select {
+		case err := <-job.result:
+			return err
+		default:
+			return ErrClientClosed
+		}
+	}
+}
+
+// LastEventID returns the id of the last event written to the client that
+// had one, or an empty string if there has been none.
+func (c *Client) LastEventID() string {
+	id, _ := c.lastID.Load().(string)
+	return id
+}
+
+// QueueLen returns the number of events queued for the client that have not
+// been written yet, including those queued with SendLatest.
+func (c *Client) QueueLen() int {
+	c.lock.Lock()
+	latest := len(c.latestKeys)
+	c.lock.Unlock()
+
+	return len(c.events) + latest
+}
+
+// QueueCap returns the number of events that may be queued with Send before
+// it blocks.
+func (c *Client) QueueCap() int {
+	return cap(c.events)
 }
 
 // Shutdown terminates a client connection
+// Events already queued are still delivered first, as with Drain.
+// It is safe to call Shutdown more than once.
 func (c *Client) Shutdown() {
-	close(c.events)
+	c.Drain()
+}
+
+// Drain stops the client accepting new events, then blocks until every event
+// queued before the call has been written and the client has terminated.
+// Any Send after Drain returns an error. Events may only be lost if the client
+// disconnects or a write fails while draining.
+func (c *Client) Drain() {
+	c.drain(nil)
+}
+
+// ShutdownWith sends a final event to the client and then shuts it down in the
+// same way as Drain, for example to tell the client not to reconnect.
+// No other event can be sent after the final event. If the client has already
+// been shut down, the event is not sent.
+func (c *Client) ShutdownWith(ev *Event) {
+	if ev == nil {
+		c.drain(nil)
+		return
+	}
+	c.drain(ev.share())
+}
+
+// Stops the client accepting events, queueing a final event if given, then
+// waits for the client to terminate
+func (c *Client) drain(final *Event) {
+	c.sendLock.Lock()
+	if !c.closed {
+		c.closed = true
+
+		// holding the lock keeps any other event from being queued after
+		// the final one
+		if final != nil {
+			select {
+			case c.events <- final:
+			case <-c.done:
+			case <-c.quit:
+			}
+		}
+
+		// queued events are still received from a closed channel, the
+		// worker only stops once they are exhausted
+		close(c.events)
+	}
+	c.sendLock.Unlock()
+
 	c.waiter.Wait()
 }
 
+// Undelivered returns the events that were queued for the client but never
+// written, for example because it disconnected, so they may be persisted or
+// sent elsewhere. It returns nil until the client has terminated, see Wait.
+// The events may be shared with other clients and must not be modified.
+func (c *Client) Undelivered() []*Event {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.undelivered
+}
+
+// Collects the events left queued once the worker has stopped
+func (c *Client) collectUndelivered() {
+	// senders hold the lock for reading until they have queued their event
+	// or seen the worker is done, so none can be missed
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	// events the worker took but never wrote came first
+	undelivered := c.unwritten
+	for pending := true; pending; {
+		select {
+		case ev, ok := <-c.events:
+			if !ok {
+				pending = false
+				continue
+			}
+			undelivered = append(undelivered, ev)
+		default:
+			pending = false
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, key := range c.latestKeys {
+		undelivered = append(undelivered, c.latest[key])
+	}
+	c.latest = nil
+	c.latestKeys = nil
+	c.undelivered = undelivered
+}
+
 // Wait blocks and waits for the client to be shutdown.
 // Call this in http handler threads to prevent the server from closing
 // the client connection.
@@ -82,28 +570,479 @@ func (c *Client) Wait() {
 	c.waiter.Wait()
 }
 
+// OnError sets a function to be called when writing to the client fails.
+// The client is closed after a failed write and the function is called from
+// the client's worker thread once it has terminated, so it may call Shutdown
+// or Drain.
+// Only one handler may be registered. Further calls overwrite the previous.
+func (c *Client) OnError(fn func(error)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onErr = fn
+}
+
+// SetRateLimit limits the rate events are written to the client to the given
+// number of events per second. Events beyond the rate are delayed rather than
+// dropped, and wait in the client's queue. Once the queue is full, Send blocks
+// until there is room.
+// A limit of 0 or less removes the limit.
+func (c *Client) SetRateLimit(eventsPerSec int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.interval = 0
+	if eventsPerSec > 0 {
+		c.interval = time.Second / time.Duration(eventsPerSec)
+	}
+}
+
+// FlushMode controls when a client flushes the events it writes to the
+// connection
+type FlushMode int
+
+const (
+	// FlushPerEvent flushes every event as soon as it is written, for the
+	// lowest latency. This is the default.
+	FlushPerEvent FlushMode = iota
+
+	// FlushCoalesced writes every event already queued before flushing once,
+	// so a burst of events costs a single flush. Events arriving steadily are
+	// still flushed at least every coalesceLimit events or coalesceDelay.
+	FlushCoalesced
+)
+
+// Bounds on how long coalesced events may go unflushed while more keep
+// arriving
+const (
+	coalesceLimit = 64
+	coalesceDelay = 10 * time.Millisecond
+)
+
+// SetFlushMode sets when the client flushes the events it writes
+func (c *Client) SetFlushMode(mode FlushMode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.flushMode = mode
+}
+
+// SetWriteDeadline sets how long writing and flushing each event to the
+// connection may take. A write that takes longer fails, which closes the
+// client rather than leaving its worker blocked on a connection that is not
+// draining. Streams from SendReader must complete within a single deadline.
+// This requires a response writer that supports write deadlines through
+// http.ResponseController, or a connection from NewClientConn, and has no
+// effect otherwise.
+// A duration of 0 disables the deadline, which is the default.
+func (c *Client) SetWriteDeadline(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeDeadline = d
+}
+
+// Guards a write to the connection with the write deadline and the write
+// timeout, if enabled. Returns a function to call once the write completes.
+func (c *Client) guardWrite() func() {
+	c.lock.Lock()
+	deadline, timeout := c.writeDeadline, c.writeTimeout
+	c.lock.Unlock()
+
+	var watchdog *time.Timer
+	if timeout > 0 {
+		watchdog = time.AfterFunc(timeout, c.stalled)
+	}
+	armed := deadline > 0 && c.setDeadline != nil &&
+		c.setDeadline(time.Now().Add(deadline)) == nil
+
+	return func() {
+		if watchdog != nil {
+			watchdog.Stop()
+		}
+		if armed {
+			c.setDeadline(time.Time{})
+		}
+	}
+}
+
+// Records a failed write to be reported once the worker stops, unless it
+// failed because the client stalled, which has already been reported
+func (c *Client) writeFailed(err error) {
+	select {
+	case <-c.quit:
+	default:
+		c.failure = err
+	}
+}
+
+// Waits until the rate limit allows another write. Returns false if the
+// client disconnected while waiting.
+func (c *Client) throttle() bool {
+	c.lock.Lock()
+	interval := c.interval
+	c.lock.Unlock()
+
+	if interval == 0 {
+		return true
+	}
+
+	now := time.Now()
+	if wait := c.nextWrite.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-c.quit:
+			return false
+		case <-c.close:
+			return false
+		case <-c.gone:
+			return false
+		case <-c.cancel:
+			return false
+		}
+		now = c.nextWrite
+	}
+	c.nextWrite = now.Add(interval)
+	return true
+}
+
+// Set stores a metadata value on the client under the given key, replacing
+// any previous value.
+// Metadata is never sent to the client and is safe to access from any goroutine.
+func (c *Client) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.meta == nil {
+		c.meta = make(map[string]interface{})
+	}
+	c.meta[key] = value
+}
+
+// Get returns the metadata value stored on the client under the given key,
+// and whether it was found.
+func (c *Client) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	value, found := c.meta[key]
+	return value, found
+}
+
+// Reports a write error to the registered handler if any
+func (c *Client) reportError(err error) {
+	c.lock.Lock()
+	fn := c.onErr
+	c.lock.Unlock()
+
+	if fn != nil {
+		fn(err)
+	}
+}
+
 // Worker thread for the client responsible for writing events
+// The worker stops as soon as the client is shutdown, disconnects, or a write
+// fails, after which no further events are accepted.
 func (c *Client) run() {
+	// the error handler is only called once the client has terminated, so
+	// that it may shut the client down itself
+	defer func() {
+		if c.failure != nil {
+			c.reportError(c.failure)
+		}
+	}()
+	defer c.waiter.Done()
+	defer c.collectUndelivered()
+	defer close(c.done)
+	defer func() {
+		c.lock.Lock()
+		c.exited = true
+		c.lock.Unlock()
+	}()
+	defer c.closeWriter()
+
+	idle := time.NewTimer(time.Hour)
+	defer idle.Stop()
 
 	for {
 		select {
 		case ev, ok := <-c.events:
-			// check for shutdown
+			// check for shutdown, delivering any keyed events first
 			if !ok {
-				c.closed = true
-				c.waiter.Done()
+				c.writeLatest()
 				return
 			}
 
-			// send the event
-			io.Copy(c.write, ev)
-			c.flush.Flush()
+			if !c.writeEvent(ev) {
+				return
+			}
+
+		case <-c.wake:
+			if !c.writeLatest() {
+				return
+			}
+
+		case job := <-c.jobs:
+			// drain everything queued ahead of the job
+			for pending := len(c.events); pending > 0; pending-- {
+				ev, ok := <-c.events
+				if !ok {
+					c.writeLatest()
+					return
+				}
+				if !c.writeEvent(ev) {
+					return
+				}
+			}
+			if !c.writeLatest() {
+				return
+			}
 
-		case _ = <-c.close.CloseNotify():
-			c.closed = true
-			c.waiter.Done()
+			// anything left by coalescing is flushed before the job
+			// completes, so Flush returns once everything has reached the
+			// client
+			disarm := c.guardWrite()
+			flushed := c.flushEvents()
+			disarm()
+			if !flushed {
+				return
+			}
+
+			if job.run == nil {
+				job.result <- nil
+				continue
+			}
+			if err := job.run(); err != nil {
+				job.result <- err
+				c.writeFailed(err)
+				return
+			}
+			job.result <- nil
+
+		case <-c.idleTimer(idle):
+			if !c.writeKeepAlive() {
+				return
+			}
+
+		case <-c.quit:
+			return
+
+		case <-c.close:
+			return
+
+		case <-c.gone:
+			return
+
+		case <-c.cancel:
 			return
 		}
 
 	}
 }
+
+// Writes and flushes a single event to the client. Returns false if the
+// write failed and the worker should stop.
+func (c *Client) writeEvent(ev *Event) bool {
+	if !c.writeFrame(ev, true) {
+		c.unwritten = append(c.unwritten, ev)
+		return false
+	}
+
+	// as in the browser, events without an id keep the last one
+	if ev.id != "" {
+		c.lastID.Store(ev.id)
+	}
+	atomic.AddUint64(&c.counters.events, uint64(ev.count()))
+	return true
+}
+
+// Writes and flushes anything in wire format to the client, without it
+// counting as an event. The flush may be left to a following event if
+// coalescing is allowed. Returns false if the write failed and the worker
+// should stop.
+func (c *Client) writeFrame(ev *Event, coalesce bool) bool {
+	// stalled clients stop without writing anything more
+	select {
+	case <-c.quit:
+		return false
+	default:
+	}
+
+	if !c.throttle() {
+		return false
+	}
+
+	disarm := c.guardWrite()
+	defer disarm()
+
+	// events may be shared between clients, so never use the
+	// stateful Read here
+	if err := writeFull(c.write, ev.Bytes()); err != nil {
+		c.writeFailed(err)
+		return false
+	}
+
+	// coalesced events are flushed by the last of those queued, or once
+	// enough of them have waited when the queue never empties
+	c.lock.Lock()
+	coalesce = coalesce && c.flushMode == FlushCoalesced
+	c.lock.Unlock()
+
+	if coalesce && len(c.events) > 0 {
+		if c.unflushed == 0 {
+			c.unflushedSince = time.Now()
+		}
+		c.unflushed++
+		if c.unflushed < coalesceLimit && time.Since(c.unflushedSince) < coalesceDelay {
+			return true
+		}
+	}
+	return c.flushEvents()
+}
+
+// Flushes everything written to the client. Returns false if the flush failed
+// and the worker should stop.
+func (c *Client) flushEvents() bool {
+	c.unflushed = 0
+	if err := c.flushWriter(); err != nil {
+		c.writeFailed(err)
+		return false
+	}
+	return true
+}
+
+// Writes all of p, retrying partial writes from writers that don't report an
+// error for them. A write that makes no progress is an io.ErrShortWrite.
+func writeFull(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// Flushes any compression and then the connection. Everything written to the
+// client, keep-alives included, must be flushed through both, or it may sit in
+// the compressor's buffer and never reach the client.
+func (c *Client) flushWriter() error {
+	if c.gz != nil {
+		if err := c.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if c.flush != nil {
+		return c.flush()
+	}
+	return nil
+}
+
+// Completes the compressed stream, if any, once the worker stops
+func (c *Client) closeWriter() {
+	if c.gz != nil {
+		c.gz.Close()
+		if c.flush != nil {
+			c.flush()
+		}
+	}
+	if c.closer != nil {
+		c.closer.Close()
+	}
+}
+
+// Checks if a response writer can be flushed, either directly or through
+// the Unwrap method of wrapping middleware as used by http.ResponseController
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case http.Flusher:
+			return true
+		case interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// Checks if the request accepts gzip content encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, entry := range strings.Split(header, ",") {
+			coding, params, _ := mime.ParseMediaType(entry)
+			if coding != "gzip" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Writes an event with data streamed from a reader, prefixing every line read
+func (c *Client) writeStream(meta *Event, r io.Reader) error {
+	disarm := c.guardWrite()
+	defer disarm()
+
+	buf := bufio.NewWriter(c.write)
+
+	// all fields but data, without the terminating blank line
+	header := meta.Bytes()
+	buf.Write(header[:len(header)-1])
+
+	src := bufio.NewReader(r)
+	lineStart := true
+	for {
+		line, err := src.ReadSlice('\n')
+		if len(line) > 0 {
+			if lineStart {
+				buf.WriteString("data: ")
+			}
+			if _, err := buf.Write(line); err != nil {
+				return err
+			}
+			lineStart = line[len(line)-1] == '\n'
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// terminate the last line and the event
+	if !lineStart {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := c.flushWriter(); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&c.counters.events, 1)
+	if meta.id != "" {
+		c.lastID.Store(meta.id)
+	}
+	return nil
+}
@@ -0,0 +1,1360 @@
+package eventsource
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A writer that may be read while a client is writing to it
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// A writer that blocks every write until released, like a connection that is
+// no longer draining, then records what was written
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	out     syncBuffer
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	b.once.Do(func() { close(b.started) })
+	<-b.release
+	return b.out.Write(p)
+}
+
+// Unblocks every write, now and in the future
+func (b *blockingWriter) unblock() {
+	close(b.release)
+}
+
+// A writer that fails every write from the nth onwards
+type failingWriter struct {
+	lock   sync.Mutex
+	failOn int
+	writes int
+	buf    bytes.Buffer
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.writes++
+	if f.writes >= f.failOn {
+		return 0, errBrokenPipe
+	}
+	return f.buf.Write(p)
+}
+
+func (f *failingWriter) String() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.buf.String()
+}
+
+// Waits for the client to terminate, failing the test if it takes too long
+func waitDone(t *testing.T, c *Client) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the client to terminate")
+	}
+}
+
+func TestSendRawEvent(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+
+	e := &Event{}
+	e.WriteRaw([]byte("data: raw\n\n"))
+	if err := c.Send(e); err != nil {
+		t.Fatal(err)
+	}
+	c.Shutdown()
+
+	if got, want := out.String(), "data: raw\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSendUnaffectedByLaterMutation(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+
+	e := DataEvent("first")
+	if err := c.Send(e); err != nil {
+		t.Fatal(err)
+	}
+	e.Data("second")
+	c.Shutdown()
+
+	if got, want := out.String(), "data: first\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestOnErrorReportsFailedWrite(t *testing.T) {
+	w := &failingWriter{failOn: 2}
+	c := NewClientWriter(w)
+
+	reported := make(chan error, 1)
+	c.OnError(func(err error) {
+		reported <- err
+	})
+
+	if err := c.Send(DataEvent("first")); err != nil {
+		t.Fatal(err)
+	}
+	c.Send(DataEvent("second"))
+
+	select {
+	case err := <-reported:
+		if err != errBrokenPipe {
+			t.Errorf("want %v, got %v", errBrokenPipe, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write error never reported")
+	}
+
+	waitDone(t, c)
+	if err := c.Send(DataEvent("third")); err != ErrClientClosed {
+		t.Errorf("Send after failed write: want %v, got %v", ErrClientClosed, err)
+	}
+	if got, want := w.String(), "data: first\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestShutdownFromErrorHandler(t *testing.T) {
+	c := NewClientWriter(&failingWriter{failOn: 1})
+	handled := make(chan struct{})
+	c.OnError(func(err error) {
+		// the obvious thing to do, which must not wait on the worker
+		// calling the handler
+		c.Shutdown()
+		c.Drain()
+		close(handled)
+	})
+	c.Send(DataEvent("fails"))
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown from the error handler never returned")
+	}
+	waitDone(t, c)
+}
+
+func TestWriteErrorStopsWorker(t *testing.T) {
+	w := &failingWriter{failOn: 1}
+	c := NewClientWriter(w)
+
+	c.Send(DataEvent("fails"))
+
+	// the writer can never signal a disconnect, so only the failed write
+	// stops the worker
+	waitDone(t, c)
+
+	// no more writes are attempted once the worker has stopped
+	c.Send(DataEvent("dropped"))
+	w.lock.Lock()
+	writes := w.writes
+	w.lock.Unlock()
+	if writes != 1 {
+		t.Errorf("want 1 write attempt, got %d", writes)
+	}
+}
+
+func TestBroadcastAfterWriteErrorReportsClosed(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	failures := s.Errors(10)
+
+	c := NewClientWriter(&failingWriter{failOn: 1})
+	s.Register(c)
+	s.Broadcast(DataEvent("fails"))
+	waitDone(t, c)
+
+	s.Broadcast(DataEvent("dropped"))
+	select {
+	case err := <-failures:
+		if err.Client != c || err.Err != ErrClientClosed {
+			t.Errorf("want %v for the client, got %v for %p", ErrClientClosed, err.Err, err.Client)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast to a dead client reported no error")
+	}
+}
+
+func TestSendReaderLargePayload(t *testing.T) {
+	var payload, want strings.Builder
+	want.WriteString("id: big\nevent: blob\n")
+
+	long := strings.Repeat("x", 64*1024)
+	for i := 0; payload.Len() < 5<<20; i++ {
+		line := "line " + strconv.Itoa(i)
+		switch {
+		case i%1000 == 0:
+			line = long
+		case i%10 == 0:
+			line = ""
+		}
+		payload.WriteString(line + "\n")
+		want.WriteString("data: " + line + "\n")
+	}
+	payload.WriteString("unterminated")
+	want.WriteString("data: unterminated\n\n")
+
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	defer c.Shutdown()
+
+	meta := (&Event{}).ID("big").Type("blob").Data("ignored")
+	if err := c.SendReader(meta, strings.NewReader(payload.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	if got != want.String() {
+		t.Fatalf("framing differs: want %d bytes, got %d bytes", want.Len(), len(got))
+	}
+	if id := c.LastEventID(); id != "big" {
+		t.Errorf("want last event id %q, got %q", "big", id)
+	}
+}
+
+func TestSendReaderOrderedWithSend(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+
+	c.Send(DataEvent("before"))
+	if err := c.SendReader(&Event{}, strings.NewReader("streamed")); err != nil {
+		t.Fatal(err)
+	}
+	c.Send(DataEvent("after"))
+	c.Shutdown()
+
+	if got, want := out.String(), "data: before\n\ndata: streamed\n\ndata: after\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// A reader that fails after returning some data
+type brokenReader struct {
+	sent bool
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, "partial\n"), nil
+	}
+	return 0, errBrokenPipe
+}
+
+func TestSendReaderErrorClosesClient(t *testing.T) {
+	c := NewClientWriter(&syncBuffer{})
+
+	if err := c.SendReader(&Event{}, &brokenReader{}); err != errBrokenPipe {
+		t.Errorf("want %v, got %v", errBrokenPipe, err)
+	}
+	waitDone(t, c)
+}
+
+func TestDrainDeliversQueuedEvents(t *testing.T) {
+	for run := 0; run < 50; run++ {
+		out := &syncBuffer{}
+		c := NewClientWriter(out)
+
+		var want strings.Builder
+		for i := 0; i < 10; i++ {
+			data := strconv.Itoa(i)
+			if err := c.Send(DataEvent(data)); err != nil {
+				t.Fatal(err)
+			}
+			want.WriteString("data: " + data + "\n\n")
+		}
+		c.Drain()
+
+		if got := out.String(); got != want.String() {
+			t.Fatalf("run %d: want %q, got %q", run, want.String(), got)
+		}
+	}
+}
+
+func TestShutdownWithSendsFinalEvent(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+
+	if err := c.Send(DataEvent("first")); err != nil {
+		t.Fatal(err)
+	}
+	c.ShutdownWith(DataEvent("bye").Type("close"))
+
+	want := "data: first\n\nevent: close\ndata: bye\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if err := c.Send(DataEvent("late")); err != ErrClientClosed {
+		t.Errorf("want %v, got %v", ErrClientClosed, err)
+	}
+}
+
+func TestShutdownWithAfterShutdown(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	c.Shutdown()
+	c.ShutdownWith(DataEvent("bye"))
+
+	if got := out.String(); got != "" {
+		t.Errorf("want nothing sent after shutdown, got %q", got)
+	}
+}
+
+func TestSendAfterDrain(t *testing.T) {
+	c := NewClientWriter(&syncBuffer{})
+	c.Drain()
+
+	if err := c.Send(DataEvent("late")); err != ErrClientClosed {
+		t.Errorf("want %v, got %v", ErrClientClosed, err)
+	}
+	if err := c.Flush(); err != ErrClientClosed {
+		t.Errorf("Flush: want %v, got %v", ErrClientClosed, err)
+	}
+
+	// draining again is harmless
+	c.Drain()
+	c.Shutdown()
+}
+
+func TestClosedClientErrors(t *testing.T) {
+	c := NewClientWriter(&syncBuffer{})
+	c.Shutdown()
+
+	sends := map[string]func() error{
+		"Send":       func() error { return c.Send(DataEvent("late")) },
+		"SendOwned":  func() error { return c.SendOwned(DataEvent("late")) },
+		"SendBatch":  func() error { return c.SendBatch([]*Event{DataEvent("late")}) },
+		"SendLatest": func() error { return c.SendLatest("key", DataEvent("late")) },
+		"SendReader": func() error { return c.SendReader(DataEvent(""), strings.NewReader("late")) },
+		"Flush":      c.Flush,
+	}
+	for name, send := range sends {
+		if err := send(); err != ErrClientClosed {
+			t.Errorf("%s: want %v, got %v", name, ErrClientClosed, err)
+		}
+	}
+}
+
+func TestDisconnectedClientErrors(t *testing.T) {
+	c := NewClientWriter(&failingWriter{failOn: 1})
+	c.Send(DataEvent("fails"))
+	waitDone(t, c)
+
+	if err := c.Send(DataEvent("late")); err != ErrClientClosed {
+		t.Errorf("want %v, got %v", ErrClientClosed, err)
+	}
+	if err := c.SendLatest("key", DataEvent("late")); err != ErrClientClosed {
+		t.Errorf("SendLatest: want %v, got %v", ErrClientClosed, err)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+
+	c.Send(DataEvent("one"))
+	c.Send(DataEvent("two"))
+	c.SendBatch([]*Event{DataEvent("three"), DataEvent("four"), DataEvent("five")})
+	c.SendBatch(nil)
+	c.Drain()
+
+	// each event in a batch counts, an empty batch counts none
+	events, bytes := c.Stats()
+	if events != 5 {
+		t.Errorf("want 5 events, got %d", events)
+	}
+	if want := uint64(len(out.String())); bytes != want {
+		t.Errorf("want %d bytes, got %d", want, bytes)
+	}
+}
+
+func TestClientStatsKeepAlive(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	c.SetKeepAlive(5 * time.Millisecond)
+	waitOutput(t, out, ":\n\n")
+	c.Shutdown()
+
+	// keep-alives are written, but are not events
+	events, bytes := c.Stats()
+	if events != 0 {
+		t.Errorf("want no events, got %d", events)
+	}
+	if want := uint64(len(out.String())); bytes != want || bytes == 0 {
+		t.Errorf("want %d bytes, got %d", want, bytes)
+	}
+}
+
+func TestSendNilEvent(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+
+	sends := map[string]func() error{
+		"Send":       func() error { return c.Send(nil) },
+		"SendOwned":  func() error { return c.SendOwned(nil) },
+		"SendBatch":  func() error { return c.SendBatch([]*Event{DataEvent("ok"), nil}) },
+		"SendLatest": func() error { return c.SendLatest("key", nil) },
+		"SendReader": func() error { return c.SendReader(nil, strings.NewReader("data")) },
+	}
+	for name, send := range sends {
+		if err := send(); err != ErrNilEvent {
+			t.Errorf("%s: want %v, got %v", name, ErrNilEvent, err)
+		}
+	}
+
+	// a nil final event shuts down without sending anything
+	c.ShutdownWith(nil)
+	if got := out.String(); got != "" {
+		t.Errorf("want nothing sent, got %q", got)
+	}
+}
+
+func TestGzipStream(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.EnableGzip()
+	connected := connections(s)
+	srv := serve(t, s)
+
+	// asking for gzip ourselves stops the transport decompressing for us
+	conn := openStream(t, srv.URL, http.Header{"Accept-Encoding": {"gzip"}})
+	if got := conn.resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("want gzip encoding, got %q", got)
+	}
+	if got := conn.resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("want Vary: Accept-Encoding, got %q", got)
+	}
+	waitClient(t, connected)
+
+	// each event must arrive without waiting for the compressor to fill
+	s.Broadcast(DataEvent("first"))
+	zr, err := gzip.NewReader(conn.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := &testConn{body: bufio.NewReader(zr)}
+	if got, want := events.next(t), "data: first\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	s.Broadcast(DataEvent("second"))
+	if got, want := events.next(t), "data: second\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestKeepAliveGzipCoalesced(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.EnableGzip()
+	s.SetKeepAlive(10 * time.Millisecond)
+	s.AddClientConnectHook(func(r *http.Request, c *Client) {
+		c.SetFlushMode(FlushCoalesced)
+	})
+	srv := serve(t, s)
+
+	// the keep-alive must be flushed through the compressor, or it never
+	// arrives to keep the connection open
+	conn := openStream(t, srv.URL, http.Header{"Accept-Encoding": {"gzip"}})
+	zr, err := gzip.NewReader(conn.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := &testConn{body: bufio.NewReader(zr)}
+	if got, want := events.next(t), ":\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSetWriterWrapper(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.EnableGzip()
+	tee := &syncBuffer{}
+	s.SetWriterWrapper(func(w io.Writer) io.Writer {
+		return io.MultiWriter(w, tee)
+	})
+	connected := connections(s)
+	srv := serve(t, s)
+
+	conn := openStream(t, srv.URL, http.Header{"Accept-Encoding": {"gzip"}})
+	waitClient(t, connected)
+	s.Broadcast(DataEvent("hi"))
+	zr, err := gzip.NewReader(conn.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := &testConn{body: bufio.NewReader(zr)}
+	if got, want := events.next(t), "data: hi\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// the wrapper sees the bytes on the connection, after compression
+	zr, err = gzip.NewReader(strings.NewReader(tee.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := (&testConn{body: bufio.NewReader(zr)}).next(t), "data: hi\n\n"; got != want {
+		t.Errorf("wrapper: want %q, got %q", want, got)
+	}
+}
+
+func TestGzipNotAccepted(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.EnableGzip()
+	connected := connections(s)
+	srv := serve(t, s)
+
+	conn := openStream(t, srv.URL, http.Header{"Accept-Encoding": {"gzip;q=0, identity"}})
+	if got := conn.resp.Header.Get("Content-Encoding"); got != "" {
+		t.Fatalf("want no encoding, got %q", got)
+	}
+	waitClient(t, connected)
+
+	s.Broadcast(DataEvent("plain"))
+	if got, want := conn.next(t), "data: plain\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// A writer recording when each write happened
+type timedWriter struct {
+	lock  sync.Mutex
+	times []time.Time
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.times = append(w.times, time.Now())
+	return len(p), nil
+}
+
+// Sends n events to a client limited to rate events per second and returns
+// the time between the first and last being written
+func rateLimitedSpread(t *testing.T, n, rate int) time.Duration {
+	w := &timedWriter{}
+	c := NewClientWriter(w)
+	c.SetRateLimit(rate)
+
+	for i := 0; i < n; i++ {
+		if err := c.Send(DataEvent(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Drain()
+
+	if len(w.times) != n {
+		t.Fatalf("want %d events written, got %d", n, len(w.times))
+	}
+	return w.times[n-1].Sub(w.times[0])
+}
+
+func TestRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes 10 seconds")
+	}
+
+	// 100 events at 10 a second are spread over 99 intervals
+	spread := rateLimitedSpread(t, 100, 10)
+	if min := 9900 * time.Millisecond; spread < min-10*time.Millisecond {
+		t.Errorf("events spread over %v, want at least %v", spread, min)
+	}
+	if max := 11 * time.Second; spread > max {
+		t.Errorf("events spread over %v, want at most %v", spread, max)
+	}
+}
+
+func TestRateLimitFast(t *testing.T) {
+	spread := rateLimitedSpread(t, 20, 200)
+	if min := 95 * time.Millisecond; spread < min-5*time.Millisecond {
+		t.Errorf("events spread over %v, want at least %v", spread, min)
+	}
+}
+
+func TestRateLimitRemoved(t *testing.T) {
+	w := &timedWriter{}
+	c := NewClientWriter(w)
+	c.SetRateLimit(1)
+	c.SetRateLimit(0)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		c.Send(DataEvent("unlimited"))
+	}
+	c.Drain()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("unlimited client took %v", elapsed)
+	}
+}
+
+func TestSendLatestKeepsMostRecent(t *testing.T) {
+	w := newBlockingWriter()
+	c := NewClientWriter(w)
+
+	// hold the worker up writing so the updates pile up behind it
+	c.Send(DataEvent("busy"))
+	<-w.started
+	for i := 1; i <= 5; i++ {
+		if err := c.SendLatest("price", DataEvent("price "+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.SendLatest("volume", DataEvent("volume 1"))
+	c.SendLatest("price", DataEvent("price 6"))
+
+	if n := c.QueueLen(); n != 2 {
+		t.Errorf("want 2 keyed events queued, got %d", n)
+	}
+
+	w.unblock()
+	c.Drain()
+
+	if got, want := w.out.String(), "data: busy\n\ndata: price 6\n\ndata: volume 1\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPublishLatest(t *testing.T) {
+	s := NewStream()
+	w := newBlockingWriter()
+	c := NewClientWriter(w)
+	s.Subscribe("prices", c)
+
+	s.Broadcast(DataEvent("busy"))
+	<-w.started
+	for i := 1; i <= 3; i++ {
+		s.PublishLatest("prices", DataEvent("price "+strconv.Itoa(i)))
+	}
+
+	w.unblock()
+	s.Shutdown()
+
+	if got, want := w.out.String(), "data: busy\n\ndata: price 3\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// A writer that counts flushes
+type flushCounter struct {
+	syncBuffer
+	flushes int32
+}
+
+func (f *flushCounter) Flush() {
+	atomic.AddInt32(&f.flushes, 1)
+}
+
+func TestClientWriterFlushes(t *testing.T) {
+	w := &flushCounter{}
+	c := NewClientWriter(w)
+	c.Send(DataEvent("one"))
+	c.Send(DataEvent("two"))
+	c.Shutdown()
+
+	if got := atomic.LoadInt32(&w.flushes); got != 2 {
+		t.Errorf("want a flush per event, got %d", got)
+	}
+}
+
+// Middleware wrapping a response writer without forwarding http.Flusher,
+// reachable only through Unwrap
+type unwrappingWriter struct {
+	http.ResponseWriter
+}
+
+func (u unwrappingWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+// Middleware with no way to reach a flusher
+type opaqueWriter struct {
+	w http.ResponseWriter
+}
+
+func (o opaqueWriter) Header() http.Header         { return o.w.Header() }
+func (o opaqueWriter) Write(p []byte) (int, error) { return o.w.Write(p) }
+func (o opaqueWriter) WriteHeader(code int)        { o.w.WriteHeader(code) }
+
+func TestNewClientThroughMiddleware(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := unwrappingWriter{rec}
+	if _, ok := interface{}(w).(http.Flusher); ok {
+		t.Fatal("test middleware must not implement http.Flusher")
+	}
+
+	c, err := NewClientError(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Send(DataEvent("through middleware"))
+	c.Shutdown()
+
+	if !rec.Flushed {
+		t.Error("response was never flushed")
+	}
+	if got, want := rec.Body.String(), "data: through middleware\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestNewClientWrapped(t *testing.T) {
+	rec := httptest.NewRecorder()
+	tee := &syncBuffer{}
+	wrapped := 0
+	c, err := NewClientWrapped(rec, httptest.NewRequest(http.MethodGet, "/", nil), func(w io.Writer) io.Writer {
+		wrapped++
+		return io.MultiWriter(w, tee)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Send(DataEvent("one"))
+	c.Send(DataEvent("two"))
+	c.Shutdown()
+
+	if wrapped != 1 {
+		t.Errorf("want the writer wrapped once, got %d", wrapped)
+	}
+	if !rec.Flushed {
+		t.Error("response was never flushed")
+	}
+	want := "data: one\n\ndata: two\n\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("response: want %q, got %q", want, got)
+	}
+	if got := tee.String(); got != want {
+		t.Errorf("wrapper: want %q, got %q", want, got)
+	}
+}
+
+func TestNewClientFlushNotSupported(t *testing.T) {
+	w := opaqueWriter{httptest.NewRecorder()}
+
+	if _, err := NewClientError(w, httptest.NewRequest(http.MethodGet, "/", nil)); err != ErrFlushNotSupported {
+		t.Errorf("want %v, got %v", ErrFlushNotSupported, err)
+	}
+	if c := NewClient(w, nil); c != nil {
+		t.Error("NewClient returned a client that cannot flush")
+	}
+}
+
+func TestQueueLen(t *testing.T) {
+	w := newBlockingWriter()
+	c := NewClientWriter(w)
+	defer c.Shutdown()
+	defer w.unblock()
+
+	if n := c.QueueLen(); n != 0 {
+		t.Errorf("want an empty queue, got %d", n)
+	}
+
+	// the worker takes the first event and blocks writing it
+	c.Send(DataEvent("writing"))
+	<-w.started
+	if n := c.QueueLen(); n != 0 {
+		t.Errorf("want an empty queue while writing, got %d", n)
+	}
+
+	c.Send(DataEvent("queued"))
+	if n := c.QueueLen(); n != 1 {
+		t.Errorf("want 1 event queued, got %d", n)
+	}
+	if n := c.QueueCap(); n != 1 {
+		t.Errorf("want a capacity of 1, got %d", n)
+	}
+
+	c.SendLatest("a", DataEvent("keyed"))
+	c.SendLatest("b", DataEvent("keyed"))
+	if n := c.QueueLen(); n != 3 {
+		t.Errorf("want 3 events queued, got %d", n)
+	}
+}
+
+func TestQueueLenConcurrent(t *testing.T) {
+	c := NewClientWriter(ioutil.Discard)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c.Send(DataEvent("event"))
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if n := c.QueueLen(); n < 0 || n > c.QueueCap() {
+			t.Fatalf("queue length %d out of range", n)
+		}
+	}
+	<-done
+	c.Shutdown()
+}
+
+func TestWriteTimeoutWithoutSends(t *testing.T) {
+	w := newBlockingWriter()
+	c := NewClientWriter(w)
+	c.SetWriteTimeout(50 * time.Millisecond)
+
+	reported := make(chan error, 1)
+	c.OnError(func(err error) {
+		reported <- err
+	})
+
+	// the only event blocks forever, so nothing but the write itself can
+	// detect the stall
+	c.Send(DataEvent("stuck"))
+	select {
+	case err := <-reported:
+		if err != ErrWriteTimeout {
+			t.Errorf("want %v, got %v", ErrWriteTimeout, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled write never reported")
+	}
+	if err := c.Send(DataEvent("after")); err != ErrWriteTimeout {
+		t.Errorf("Send after stall: want %v, got %v", ErrWriteTimeout, err)
+	}
+
+	// a plain writer can't be interrupted, so the worker stops once the
+	// write returns, and reports nothing more
+	w.unblock()
+	waitDone(t, c)
+	select {
+	case err := <-reported:
+		t.Errorf("unexpected error after stall: %v", err)
+	default:
+	}
+}
+
+func TestWriteTimeoutInterruptsConn(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+
+	// read the response header, then stop reading like a stalled peer
+	go io.ReadFull(peer, make([]byte, len(connResponse)))
+	c, err := NewClientConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteTimeout(50 * time.Millisecond)
+
+	reported := make(chan error, 1)
+	c.OnError(func(err error) {
+		reported <- err
+	})
+	c.Send(DataEvent("stuck"))
+
+	// the blocked write is interrupted, so the worker stops on its own
+	waitDone(t, c)
+	if err := <-reported; err != ErrWriteTimeout {
+		t.Errorf("want %v, got %v", ErrWriteTimeout, err)
+	}
+}
+
+func TestWriteTimeoutSlowReader(t *testing.T) {
+	w := &timedWriter{}
+	c := NewClientWriter(w)
+	c.SetWriteTimeout(200 * time.Millisecond)
+	c.SetRateLimit(50)
+
+	// waiting on the rate limit is not a stalled write, even when Send waits
+	// far longer than the timeout in total
+	for i := 0; i < 30; i++ {
+		if err := c.Send(DataEvent("event")); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+	c.Drain()
+	waitDone(t, c)
+}
+
+func TestWriteDeadlineStopsWorker(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+
+	// read the response header, then never drain the connection again
+	go io.ReadFull(peer, make([]byte, len(connResponse)))
+	c, err := NewClientConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteDeadline(50 * time.Millisecond)
+
+	reported := make(chan error, 1)
+	c.OnError(func(err error) {
+		reported <- err
+	})
+	c.Send(DataEvent("stuck"))
+
+	// the write fails at the deadline instead of blocking forever
+	waitDone(t, c)
+	var netErr net.Error
+	if err := <-reported; !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("want a timeout error, got %v", err)
+	}
+	if err := c.Send(DataEvent("after")); err != ErrClientClosed {
+		t.Errorf("Send after deadline: want %v, got %v", ErrClientClosed, err)
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	c := NewClientWriter(ioutil.Discard)
+	if id := c.LastEventID(); id != "" {
+		t.Errorf("want no id before any event, got %q", id)
+	}
+
+	for _, id := range []string{"1", "2", "3"} {
+		c.Send(DataEvent("event").ID(id))
+	}
+	// events without an id leave the last one in place
+	c.Send(DataEvent("no id"))
+	c.Drain()
+
+	if got, want := c.LastEventID(), "3"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// A writer accepting at most max bytes per write, and none once stuck
+type shortWriter struct {
+	max   int
+	stuck bool
+	out   syncBuffer
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.stuck {
+		return 0, nil
+	}
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.out.Write(p)
+}
+
+func TestShortWritesCompleted(t *testing.T) {
+	w := &shortWriter{max: 3}
+	c := NewClientWriter(w)
+
+	c.Send((&Event{}).ID("1").Data("a longer payload\nover two lines"))
+	c.Drain()
+
+	if got, want := w.out.String(), "id: 1\ndata: a longer payload\ndata: over two lines\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestShortWriteWithoutProgress(t *testing.T) {
+	c := NewClientWriter(&shortWriter{stuck: true})
+
+	reported := make(chan error, 1)
+	c.OnError(func(err error) {
+		reported <- err
+	})
+	c.Send(DataEvent("never written"))
+
+	waitDone(t, c)
+	if err := <-reported; err != io.ErrShortWrite {
+		t.Errorf("want %v, got %v", io.ErrShortWrite, err)
+	}
+}
+
+// A writer that only makes what was written visible once flushed, recording
+// the most events made visible by a single flush
+type bufferedFlusher struct {
+	lock     sync.Mutex
+	delay    time.Duration
+	onWrite  func(p []byte)
+	pending  bytes.Buffer
+	out      bytes.Buffer
+	flushes  int
+	maxBatch int
+}
+
+func (b *bufferedFlusher) Write(p []byte) (int, error) {
+	if b.onWrite != nil {
+		b.onWrite(p)
+	}
+	time.Sleep(b.delay)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.pending.Write(p)
+}
+
+func (b *bufferedFlusher) Flush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if n := bytes.Count(b.pending.Bytes(), []byte("\n\n")); n > b.maxBatch {
+		b.maxBatch = n
+	}
+	b.pending.WriteTo(&b.out)
+	b.flushes++
+}
+
+func (b *bufferedFlusher) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.out.String()
+}
+
+func TestFlushCoalescedBurst(t *testing.T) {
+	w := &bufferedFlusher{}
+	c := NewClientWriter(w)
+	c.SetFlushMode(FlushCoalesced)
+
+	// hold the first write until the second event has queued behind it
+	release := make(chan struct{})
+	w.onWrite = func(p []byte) {
+		if string(p) == "data: 0\n\n" {
+			<-release
+		}
+	}
+	c.Send(DataEvent("0"))
+	c.Send(DataEvent("1"))
+	close(release)
+	c.Drain()
+
+	if got, want := w.String(), "data: 0\n\ndata: 1\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if w.flushes != 1 {
+		t.Errorf("want the burst flushed once, got %d flushes", w.flushes)
+	}
+}
+
+func TestFlushCoalescedSteadyStream(t *testing.T) {
+	// slow writes let the sender refill the queue before each one returns,
+	// so the queue is never seen empty
+	w := &bufferedFlusher{delay: 100 * time.Microsecond}
+	c := NewClientWriter(w)
+	c.SetFlushMode(FlushCoalesced)
+
+	for i := 0; i < 500; i++ {
+		c.Send(DataEvent("event"))
+	}
+	c.Drain()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.maxBatch > coalesceLimit {
+		t.Errorf("want at most %d events per flush, got %d", coalesceLimit, w.maxBatch)
+	}
+	if got := strings.Count(w.out.String(), "\n\n"); got != 500 {
+		t.Errorf("want 500 events, got %d", got)
+	}
+}
+
+func TestFlushBarrierCoalesced(t *testing.T) {
+	for run := 0; run < 50; run++ {
+		w := &bufferedFlusher{}
+		c := NewClientWriter(w)
+		c.SetFlushMode(FlushCoalesced)
+
+		// hold the first write until the barrier is waiting, then have
+		// writing the second event queue a third, so coalescing leaves the
+		// second unflushed for the barrier to deal with. The third is held
+		// until the barrier has been checked, unless it is written ahead of
+		// the barrier.
+		release, checked := make(chan struct{}), make(chan struct{})
+		w.onWrite = func(p []byte) {
+			switch string(p) {
+			case "data: first\n\n":
+				<-release
+			case "data: second\n\n":
+				c.Send(DataEvent("third"))
+			case "data: third\n\n":
+				select {
+				case <-checked:
+				case <-time.After(20 * time.Millisecond):
+				}
+			}
+		}
+		c.Send(DataEvent("first"))
+		c.Send(DataEvent("second"))
+
+		flushed := make(chan error, 1)
+		go func() {
+			flushed <- c.Flush()
+		}()
+		time.Sleep(time.Millisecond)
+		close(release)
+		if err := <-flushed; err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := w.String(), "data: first\n\ndata: second\n\n"; !strings.HasPrefix(got, want) {
+			t.Fatalf("run %d: want %q flushed, got %q", run, want, got)
+		}
+		close(checked)
+		c.Shutdown()
+	}
+}
+
+// Flushes needed for a burst of 1000 events in each flush mode
+func BenchmarkFlushBurst(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		mode FlushMode
+	}{
+		{"PerEvent", FlushPerEvent},
+		{"Coalesced", FlushCoalesced},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			e := DataEvent("burst")
+			flushes := 0
+			for i := 0; i < b.N; i++ {
+				w := &bufferedFlusher{}
+				c := NewClientWriter(w)
+				c.SetFlushMode(bench.mode)
+				for j := 0; j < 1000; j++ {
+					c.Send(e)
+				}
+				c.Drain()
+				flushes += w.flushes
+			}
+			b.ReportMetric(float64(flushes)/float64(b.N), "flushes/op")
+		})
+	}
+}
+
+// Serves clients created with NewClientContext, handing each to the test
+// along with the function cancelling its context
+func serveContextClients(t *testing.T) (*httptest.Server, <-chan *Client, <-chan context.CancelFunc) {
+	clients := make(chan *Client, 1)
+	cancels := make(chan context.CancelFunc, 1)
+	srv := serve(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c, err := NewClientContext(ctx, w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		clients <- c
+		cancels <- cancel
+		c.Wait()
+	}))
+	return srv, clients, cancels
+}
+
+func TestNewClientContextCancel(t *testing.T) {
+	srv, clients, cancels := serveContextClients(t)
+	conn := openStream(t, srv.URL, nil)
+	c := <-clients
+	c.Send(DataEvent("before"))
+	if got, want := conn.next(t), "data: before\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// cancelling stops the client and ends the response
+	(<-cancels)()
+	waitDone(t, c)
+	if err := c.Send(DataEvent("after")); err != ErrClientClosed {
+		t.Errorf("want %v, got %v", ErrClientClosed, err)
+	}
+	if rest, err := ioutil.ReadAll(conn.body); err != nil || len(rest) != 0 {
+		t.Errorf("want the response to end, got %q, %v", rest, err)
+	}
+}
+
+func TestNewClientContextDisconnectThenCancel(t *testing.T) {
+	srv, clients, cancels := serveContextClients(t)
+	conn := openStream(t, srv.URL, nil)
+	c := <-clients
+	cancel := <-cancels
+
+	// a disconnect stops the client, and a later cancel is harmless
+	conn.close()
+	waitDone(t, c)
+	cancel()
+	c.Shutdown()
+	waitDone(t, c)
+}
+
+func TestUndelivered(t *testing.T) {
+	w := newBlockingWriter()
+	c := NewClientWriter(w)
+	c.SetWriteTimeout(10 * time.Millisecond)
+	stalled := make(chan error, 1)
+	c.OnError(func(err error) {
+		stalled <- err
+	})
+
+	// hold the worker on a write while more events are queued
+	c.Send(DataEvent("stuck"))
+	<-w.started
+	c.Send(DataEvent("queued"))
+	c.SendLatest("key", DataEvent("latest"))
+	if got := c.Undelivered(); got != nil {
+		t.Errorf("want nil while running, got %v", got)
+	}
+
+	<-stalled
+	w.unblock()
+	waitDone(t, c)
+
+	// the latest event may be taken by the worker first, so the order
+	// between the two is not fixed
+	var got []string
+	for _, ev := range c.Undelivered() {
+		got = append(got, strings.Join(ev.GetData(), "\n"))
+	}
+	sort.Strings(got)
+	if want := []string{"latest", "queued"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q undelivered, got %q", want, got)
+	}
+}
+
+func TestUndeliveredAfterDrain(t *testing.T) {
+	c := NewClientWriter(&syncBuffer{})
+	c.Send(DataEvent("one"))
+	c.SendLatest("key", DataEvent("two"))
+	c.Drain()
+
+	if got := c.Undelivered(); got != nil {
+		t.Errorf("want everything delivered, got %v", got)
+	}
+}
+
+func TestSendOwnedNotCopied(t *testing.T) {
+	w := newBlockingWriter()
+	c := NewClientWriter(w)
+	c.SetWriteTimeout(10 * time.Millisecond)
+	stalled := make(chan error, 1)
+	c.OnError(func(err error) {
+		stalled <- err
+	})
+
+	// hold the worker on a write, so the next event stays queued until the
+	// client stalls
+	c.Send(DataEvent("stuck"))
+	<-w.started
+	owned := DataEvent("owned")
+	if err := c.SendOwned(owned); err != nil {
+		t.Fatal(err)
+	}
+	<-stalled
+	w.unblock()
+	waitDone(t, c)
+
+	// the client queued the caller's event itself, which is why it must
+	// never be touched again
+	undelivered := c.Undelivered()
+	if len(undelivered) != 1 || undelivered[0] != owned {
+		t.Fatalf("want the owned event itself queued, got %v", undelivered)
+	}
+}
+
+func TestSendOwnedFailedWriteUndelivered(t *testing.T) {
+	c := NewClientWriter(&failingWriter{failOn: 1})
+	owned := DataEvent("owned")
+	if err := c.SendOwned(owned); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, c)
+
+	// the worker had taken the event from the queue, but never wrote it
+	undelivered := c.Undelivered()
+	if len(undelivered) != 1 || undelivered[0] != owned {
+		t.Fatalf("want the failed event undelivered, got %v", undelivered)
+	}
+}
+
+func TestSendOwnedDelivered(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+
+	if err := c.SendOwned(DataEvent("owned").ID("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendOwned(nil); err != ErrNilEvent {
+		t.Errorf("want %v, got %v", ErrNilEvent, err)
+	}
+	c.Shutdown()
+
+	if got, want := out.String(), "id: 1\ndata: owned\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// Sending a fresh event each time copies it
+func BenchmarkSendFresh(b *testing.B) {
+	c := NewClientWriter(ioutil.Discard)
+	defer c.Shutdown()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		c.Send((&Event{}).AppendBytes(largePayload))
+	}
+}
+
+// Sending a fresh event owned by the client saves the copy
+func BenchmarkSendOwnedFresh(b *testing.B) {
+	c := NewClientWriter(ioutil.Discard)
+	defer c.Shutdown()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		c.SendOwned((&Event{}).AppendBytes(largePayload))
+	}
+}
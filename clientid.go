@@ -0,0 +1,94 @@
+package eventsource
+
+import (
+	"errors"
+)
+
+// ErrUnknownClient is returned by SendTo when no client has the given id
+var ErrUnknownClient = errors.New("eventsource: no client with that id")
+
+// SetClientIDKey sets the metadata key holding each client's id, to index
+// clients for SendTo. The id must be a string, stored with Client.Set before
+// the client is registered or from a connect hook. Several clients may share
+// an id, for example when a user has more than one connection.
+// An empty key disables the index, which is the default.
+func (s *Stream) SetClientIDKey(key string) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	s.idKey = key
+	s.byID = nil
+	s.idOf = nil
+	for c := range s.clients {
+		s.indexID(c)
+	}
+}
+
+// SendTo sends the event to every client registered on this stream with the
+// given id, see SetClientIDKey.
+// Returns ErrUnknownClient if there is no such client, or the first error from
+// sending to one of them. The event is still sent to the others.
+func (s *Stream) SendTo(id string, e *Event) error {
+	if e == nil {
+		return ErrNilEvent
+	}
+	defer s.sequence()()
+
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+
+	clients := s.byID[id]
+	if len(clients) == 0 {
+		return ErrUnknownClient
+	}
+
+	d := s.deliver(e, false, nil)
+	if d == nil {
+		return ErrEventTooLarge
+	}
+
+	for cli := range clients {
+		d.to(cli)
+	}
+	return d.err
+}
+
+// Indexes a registered client by its id, if the stream has an id key.
+// Must be called with the stream's lock held.
+func (s *Stream) indexID(c *Client) {
+	if s.idKey == "" {
+		return
+	}
+	s.unindexID(c)
+
+	value, _ := c.Get(s.idKey)
+	id, _ := value.(string)
+	if id == "" {
+		return
+	}
+
+	if s.byID == nil {
+		s.byID = make(map[string]map[*Client]bool)
+		s.idOf = make(map[*Client]string)
+	}
+	if s.byID[id] == nil {
+		s.byID[id] = make(map[*Client]bool)
+	}
+	s.byID[id][c] = true
+	s.idOf[c] = id
+}
+
+// Removes a client from the id index.
+// Must be called with the stream's lock held.
+func (s *Stream) unindexID(c *Client) {
+	id, found := s.idOf[c]
+	if !found {
+		return
+	}
+
+	delete(s.idOf, c)
+	delete(s.byID[id], c)
+	if len(s.byID[id]) == 0 {
+		delete(s.byID, id)
+	}
+}
@@ -0,0 +1,72 @@
+package eventsource
+
+import (
+	"testing"
+)
+
+// Registers a client with an id on the stream, capturing what it is sent
+func clientWithID(s *Stream, id string) (*Client, *syncBuffer) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	c.Set("user", id)
+	s.Register(c)
+	return c, out
+}
+
+func TestSendTo(t *testing.T) {
+	s := NewStream()
+	s.SetClientIDKey("user")
+	_, alice := clientWithID(s, "alice")
+	_, bob := clientWithID(s, "bob")
+	// a second connection for the same user
+	_, alice2 := clientWithID(s, "alice")
+
+	if err := s.SendTo("alice", DataEvent("for alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendTo("carol", DataEvent("for nobody")); err != ErrUnknownClient {
+		t.Errorf("want %v, got %v", ErrUnknownClient, err)
+	}
+	s.Shutdown()
+
+	for name, out := range map[string]*syncBuffer{"alice": alice, "alice again": alice2} {
+		if got, want := out.String(), "data: for alice\n\n"; got != want {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+	if got := bob.String(); got != "" {
+		t.Errorf("bob: want nothing, got %q", got)
+	}
+}
+
+func TestSendToAfterRemove(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetClientIDKey("user")
+	c, _ := clientWithID(s, "alice")
+
+	s.Remove(c)
+	c.Shutdown()
+	if err := s.SendTo("alice", DataEvent("gone")); err != ErrUnknownClient {
+		t.Errorf("want %v, got %v", ErrUnknownClient, err)
+	}
+}
+
+func TestSetClientIDKeyIndexesRegistered(t *testing.T) {
+	s := NewStream()
+	_, out := clientWithID(s, "alice")
+
+	// clients registered before the key was set are indexed too
+	if err := s.SendTo("alice", DataEvent("unindexed")); err != ErrUnknownClient {
+		t.Errorf("want %v before the key is set, got %v", ErrUnknownClient, err)
+	}
+	s.SetClientIDKey("user")
+	if err := s.SendTo("alice", DataEvent("indexed")); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+
+	if got, want := out.String(), "data: indexed\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
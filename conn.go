@@ -0,0 +1,43 @@
+package eventsource
+
+import (
+	"io"
+	"net"
+)
+
+// connResponse is written ahead of the event stream on raw connections. The
+// stream has no length, so the response ends when the connection is closed.
+const connResponse = "HTTP/1.1 200 OK\r\n" +
+	"Content-Type: text/event-stream\r\n" +
+	"Cache-Control: no-cache\r\n" +
+	"Connection: close\r\n" +
+	"\r\n"
+
+// NewClientConn creates a client streaming events over a raw connection, such
+// as one hijacked from an http.ResponseWriter, for use outside the normal
+// handler flow. The HTTP response status line and headers are written to the
+// connection before any events.
+// Disconnects are detected by reading from the connection, so nothing else
+// may read from it. The client closes the connection when it terminates.
+func NewClientConn(conn net.Conn) (*Client, error) {
+	if _, err := io.WriteString(conn, connResponse); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := allocClient(conn)
+	c.setDeadline = conn.SetWriteDeadline
+	c.closer = conn
+
+	// the peer sends nothing more after its request, so the read only ends
+	// when the connection does
+	gone := make(chan struct{})
+	c.gone = gone
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	c.start()
+	return c, nil
+}
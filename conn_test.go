@@ -0,0 +1,69 @@
+package eventsource
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Starts a client on one end of an in-memory connection, returning the
+// response read from the other
+func pipeClient(t *testing.T) (*Client, *testConn, net.Conn) {
+	t.Helper()
+
+	server, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+
+	body := bufio.NewReader(peer)
+	read := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.ReadResponse(body, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- resp
+	}()
+
+	c, err := NewClientConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &testConn{resp: <-read, body: body}, peer
+}
+
+func TestNewClientConn(t *testing.T) {
+	c, conn, _ := pipeClient(t)
+	defer c.Shutdown()
+
+	if conn.resp.StatusCode != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, conn.resp.StatusCode)
+	}
+	if ct := conn.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("want an event stream, got %q", ct)
+	}
+
+	go c.Send(DataEvent("over a pipe").ID("1"))
+	if got, want := conn.next(t), "id: 1\ndata: over a pipe\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestNewClientConnPeerCloses(t *testing.T) {
+	c, _, peer := pipeClient(t)
+
+	// the peer going away is detected without any write
+	peer.Close()
+	waitDone(t, c)
+}
+
+func TestNewClientConnShutdownCloses(t *testing.T) {
+	c, conn, _ := pipeClient(t)
+
+	c.Shutdown()
+	waitDone(t, c)
+	if _, err := conn.body.ReadByte(); err != io.EOF {
+		t.Errorf("want the connection closed, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package eventsource
+
+import (
+	"crypto/x509"
+	"net/http"
+)
+
+// ConnInfo describes the connection a client was created for, as a record
+// for auditing and logging
+type ConnInfo struct {
+	// RemoteAddr is the network address of the peer
+	RemoteAddr string
+	// Proto is the protocol version of the request, such as "HTTP/2.0"
+	Proto string
+	// ProtoMajor and ProtoMinor are the numbers of the protocol version
+	ProtoMajor, ProtoMinor int
+	// TLS is true if the connection was made over TLS
+	TLS bool
+	// ServerName is the server name the peer asked for with SNI, if any
+	ServerName string
+	// NegotiatedProtocol is the protocol agreed with ALPN, if any
+	NegotiatedProtocol string
+	// PeerCertificates are the certificates presented by the peer, leaf first
+	PeerCertificates []*x509.Certificate
+}
+
+// PeerSubject returns the subject of the certificate the peer authenticated
+// with, or an empty string if it presented none
+func (info ConnInfo) PeerSubject() string {
+	if len(info.PeerCertificates) == 0 {
+		return ""
+	}
+	return info.PeerCertificates[0].Subject.String()
+}
+
+// ConnInfo returns information about the connection the client was created
+// for. It is empty for clients created without a request.
+func (c *Client) ConnInfo() ConnInfo {
+	return c.info
+}
+
+// Records the connection information from the request
+func connInfo(req *http.Request) ConnInfo {
+	info := ConnInfo{
+		RemoteAddr: req.RemoteAddr,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+	}
+	if req.TLS != nil {
+		info.TLS = true
+		info.ServerName = req.TLS.ServerName
+		info.NegotiatedProtocol = req.TLS.NegotiatedProtocol
+		info.PeerCertificates = req.TLS.PeerCertificates
+	}
+	return info
+}
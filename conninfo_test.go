@@ -0,0 +1,100 @@
+package eventsource
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Creates a self-signed certificate for a TLS client
+func clientCertificate(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestConnInfoTLS(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	client := srv.Client()
+	config := client.Transport.(*http.Transport).TLSClientConfig
+	config.Certificates = []tls.Certificate{clientCertificate(t, "audited client")}
+	// the test server's certificate is valid for example.com
+	config.ServerName = "example.com"
+
+	openStreamWith(t, client, srv.URL, nil)
+	info := waitClient(t, connected).ConnInfo()
+
+	if !info.TLS {
+		t.Error("want a TLS connection")
+	}
+	if got, want := info.PeerSubject(), "CN=audited client"; got != want {
+		t.Errorf("want subject %q, got %q", want, got)
+	}
+	if info.ServerName != "example.com" {
+		t.Errorf("want server name %q, got %q", "example.com", info.ServerName)
+	}
+	if info.ProtoMajor != 2 || info.NegotiatedProtocol != "h2" {
+		t.Errorf("want HTTP/2 negotiated with ALPN, got %s and %q", info.Proto, info.NegotiatedProtocol)
+	}
+	if info.RemoteAddr == "" {
+		t.Error("want the remote address")
+	}
+}
+
+func TestConnInfoPlain(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+	srv := serve(t, s)
+
+	openStream(t, srv.URL, nil)
+	info := waitClient(t, connected).ConnInfo()
+
+	if info.TLS || info.PeerSubject() != "" || info.ServerName != "" {
+		t.Errorf("want no TLS details, got %+v", info)
+	}
+	if info.ProtoMajor != 1 {
+		t.Errorf("want HTTP/1, got %s", info.Proto)
+	}
+
+	// clients without a request have nothing to report
+	c := NewClientWriter(ioutil.Discard)
+	defer c.Shutdown()
+	if info := c.ConnInfo(); info.Proto != "" || info.TLS {
+		t.Errorf("want empty info, got %+v", info)
+	}
+}
@@ -0,0 +1,63 @@
+package eventsource
+
+import (
+	"net/http"
+)
+
+// AllowOrigin enables CORS on this stream's HTTP handlers for the given
+// origins. An origin of "*" allows any origin.
+// When a request's Origin header is allowed it is echoed back in the
+// Access-Control-Allow-Origin header, or "*" is sent if any origin is allowed
+// and credentials are not.
+// Further calls overwrite the previous origins. Calling with no origins
+// disables CORS.
+func (s *Stream) AllowOrigin(origins ...string) {
+	s.corsOrigins = make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		s.corsOrigins[origin] = true
+	}
+}
+
+// AllowCredentials sets whether cross origin requests may include
+// credentials such as cookies, by sending Access-Control-Allow-Credentials.
+// Has no effect unless AllowOrigin has been called.
+func (s *Stream) AllowCredentials(allow bool) {
+	s.corsCredentials = allow
+}
+
+// Sets the CORS response headers for the request. Returns true if the
+// request was a preflight request that has been answered.
+func (s *Stream) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(s.corsOrigins) == 0 || origin == "" {
+		return false
+	}
+
+	allowed := s.corsOrigins[origin] || s.corsOrigins["*"]
+	if allowed {
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		if s.corsOrigins["*"] && !s.corsCredentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if s.corsCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	// answer preflight requests
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	if allowed {
+		header := w.Header()
+		header.Set("Access-Control-Allow-Methods", "GET")
+		if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,111 @@
+package eventsource
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		origin      string
+		allowOrigin string
+		allowCreds  string
+	}{
+		{"listed origin", []string{"https://a.example", "https://b.example"}, false, "https://b.example", "https://b.example", ""},
+		{"listed origin with credentials", []string{"https://a.example"}, true, "https://a.example", "https://a.example", "true"},
+		{"any origin", []string{"*"}, false, "https://a.example", "*", ""},
+		{"any origin with credentials", []string{"*"}, true, "https://a.example", "https://a.example", "true"},
+		{"disallowed origin", []string{"https://a.example"}, true, "https://evil.example", "", ""},
+		{"no origin", []string{"*"}, false, "", "", ""},
+		{"cors disabled", nil, false, "https://a.example", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewStream()
+			s.AllowOrigin(test.origins...)
+			s.AllowCredentials(test.credentials)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			if s.handleCORS(rec, req) {
+				t.Fatal("GET request answered as a preflight request")
+			}
+
+			header := rec.Header()
+			if got := header.Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+				t.Errorf("want Access-Control-Allow-Origin %q, got %q", test.allowOrigin, got)
+			}
+			if got := header.Get("Access-Control-Allow-Credentials"); got != test.allowCreds {
+				t.Errorf("want Access-Control-Allow-Credentials %q, got %q", test.allowCreds, got)
+			}
+			if test.allowOrigin != "" && header.Get("Vary") != "Origin" {
+				t.Errorf("want Vary: Origin, got %q", header.Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestCORSStream(t *testing.T) {
+	s := NewStream()
+	s.AllowOrigin("https://a.example")
+	srv := serve(t, s)
+
+	conn := openStream(t, srv.URL, http.Header{"Origin": {"https://a.example"}})
+	defer conn.close()
+	if got := conn.resp.Header.Get("Access-Control-Allow-Origin"); got != "https://a.example" {
+		t.Errorf("want origin echoed back, got %q", got)
+	}
+	s.Shutdown()
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s := NewStream()
+	s.AllowOrigin("https://a.example")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://a.example")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "Last-Event-ID")
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("want 204 for a preflight request, got %d", rec.Code)
+	}
+	header := rec.Header()
+	if got := header.Get("Access-Control-Allow-Origin"); got != "https://a.example" {
+		t.Errorf("want origin echoed back, got %q", got)
+	}
+	if got := header.Get("Access-Control-Allow-Methods"); got != "GET" {
+		t.Errorf("want GET allowed, got %q", got)
+	}
+	if got := header.Get("Access-Control-Allow-Headers"); got != "Last-Event-ID" {
+		t.Errorf("want requested headers allowed, got %q", got)
+	}
+}
+
+func TestCORSPreflightDisallowed(t *testing.T) {
+	s := NewStream()
+	s.AllowOrigin("https://a.example")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("want 204 for a preflight request, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("want no allowed origin, got %q", got)
+	}
+}
@@ -0,0 +1,101 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ClientDebug describes a client in the body written by a stream's
+// DebugHandler
+type ClientDebug struct {
+	// RemoteAddr is the network address of the client, if known
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Metadata are the client's metadata values, formatted as strings
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Topics are the topics the client is subscribed to
+	Topics []string `json:"topics"`
+	// LastEventID is the id of the last event written to the client
+	LastEventID string `json:"last_event_id,omitempty"`
+	// QueueDepth is the number of events queued for the client
+	QueueDepth int `json:"queue_depth"`
+	// Connected is the number of seconds since the client was created
+	Connected float64 `json:"connected_seconds"`
+}
+
+// EnableDebug turns on the stream's DebugHandler. It is off by default as it
+// exposes the metadata of every client.
+func (s *Stream) EnableDebug() {
+	s.debug = true
+}
+
+// DebugHandler returns a handler listing every client on the stream as JSON,
+// with its metadata, topics, last event id, queue depth and how long it has
+// been connected, for troubleshooting.
+// It responds with 404 Not Found unless enabled with EnableDebug.
+func (s *Stream) DebugHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.debug {
+			http.NotFound(w, r)
+			return
+		}
+
+		// only hold the lock long enough to copy the subscriptions
+		type entry struct {
+			client *Client
+			topics []string
+		}
+		s.listLock.RLock()
+		entries := make([]entry, 0, len(s.clients))
+		for c, topics := range s.clients {
+			e := entry{client: c, topics: []string{}}
+			for topic, subscribed := range topics {
+				if subscribed {
+					e.topics = append(e.topics, topic)
+				}
+			}
+			entries = append(entries, e)
+		}
+		s.listLock.RUnlock()
+
+		now := time.Now()
+		clients := make([]ClientDebug, 0, len(entries))
+		for _, e := range entries {
+			sort.Strings(e.topics)
+			clients = append(clients, ClientDebug{
+				RemoteAddr:  e.client.info.RemoteAddr,
+				Metadata:    e.client.metadata(),
+				Topics:      e.topics,
+				LastEventID: e.client.LastEventID(),
+				QueueDepth:  e.client.QueueLen(),
+				Connected:   now.Sub(e.client.ConnectedAt()).Seconds(),
+			})
+		}
+
+		// oldest clients first
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].Connected > clients[j].Connected
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(clients)
+	}
+}
+
+// Copies the client's metadata, formatting each value as a string
+func (c *Client) metadata() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.meta) == 0 {
+		return nil
+	}
+	meta := make(map[string]string, len(c.meta))
+	for key, value := range c.meta {
+		meta[key] = fmt.Sprint(value)
+	}
+	return meta
+}
@@ -0,0 +1,83 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Calls the stream's debug handler and decodes the clients listed
+func debugClients(t *testing.T, s *Stream) []ClientDebug {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.DebugHandler()(rec, httptest.NewRequest("GET", "/debug", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want JSON content type, got %q", ct)
+	}
+	var clients []ClientDebug
+	if err := json.NewDecoder(rec.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	return clients
+}
+
+func TestDebugHandlerDisabled(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	captureClient(s)
+
+	rec := httptest.NewRecorder()
+	s.DebugHandler()(rec, httptest.NewRequest("GET", "/debug", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("want 404 until enabled, got %d", rec.Code)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.EnableDebug()
+
+	if clients := debugClients(t, s); len(clients) != 0 {
+		t.Fatalf("want no clients, got %+v", clients)
+	}
+
+	first, _ := captureClient(s)
+	first.Set("user", 42)
+	first.Send(DataEvent("hi").ID("7"))
+	first.Flush()
+	s.Subscribe("b", first)
+	s.Subscribe("a", first)
+	second := NewClientWriter(&syncBuffer{})
+	s.Subscribe("c", second)
+
+	clients := debugClients(t, s)
+	if len(clients) != 2 {
+		t.Fatalf("want 2 clients, got %+v", clients)
+	}
+
+	// oldest first, with sorted topics
+	got := clients[0]
+	if !reflect.DeepEqual(got.Topics, []string{"a", "b"}) {
+		t.Errorf("want topics a and b, got %q", got.Topics)
+	}
+	if !reflect.DeepEqual(got.Metadata, map[string]string{"user": "42"}) {
+		t.Errorf("want formatted metadata, got %q", got.Metadata)
+	}
+	if got.LastEventID != "7" {
+		t.Errorf("want last event id 7, got %q", got.LastEventID)
+	}
+	if clients[0].Connected < clients[1].Connected {
+		t.Errorf("want the oldest client first, got %+v", clients)
+	}
+	if !reflect.DeepEqual(clients[1].Topics, []string{"c"}) || clients[1].Metadata != nil {
+		t.Errorf("want the second client on c without metadata, got %+v", clients[1])
+	}
+}
@@ -0,0 +1,116 @@
+package eventsource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+)
+
+// Decoder reads events in wire format from a stream, such as the body of a
+// response from another event stream server.
+// Lines may end in either "\n" or "\r\n". Comments are skipped, and fields
+// other than id, event, data and retry are kept as custom fields where
+// possible.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder creates a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Decode reads the next complete event from the stream.
+// Returns io.EOF once the stream ends. An incomplete event at the end of the
+// stream is discarded.
+func (d *Decoder) Decode() (*Event, error) {
+	e := &Event{}
+	empty := true
+
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if err != nil {
+			// unterminated lines and events are never dispatched
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+
+		// a blank line ends the event
+		if len(line) == 0 {
+			if empty {
+				continue
+			}
+			return e, nil
+		}
+
+		// comments
+		if line[0] == ':' {
+			continue
+		}
+
+		name, value := line, []byte{}
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			name, value = line[:i], line[i+1:]
+			// at most one leading space is part of the format
+			value = bytes.TrimPrefix(value, []byte{' '})
+		}
+
+		switch string(name) {
+		case "id":
+			e.ID(string(value))
+		case "event":
+			e.Type(string(value))
+		case "data":
+			e.data = append(e.data, append([]byte(nil), value...))
+			e.bufSet = false
+		case "retry":
+			retry, err := strconv.ParseUint(string(value), 10, 64)
+			if err != nil {
+				// invalid retry fields are ignored
+				continue
+			}
+			e.Retry(retry)
+		default:
+			if e.WriteField(string(name), string(value)) != nil {
+				continue
+			}
+		}
+		empty = false
+	}
+}
+
+// Relay reads events in wire format from r and broadcasts each of them to
+// the clients of this stream, until r is exhausted or the context is done.
+// This allows the stream to fan out events from another event stream.
+// Returns nil once r is exhausted, or the error from reading or the context.
+// A read that is blocked is not interrupted by the context, so r should be
+// closed when the context is done, as an http.Response body made with the
+// same context is.
+func (s *Stream) Relay(ctx context.Context, r io.Reader) error {
+	dec := NewDecoder(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+
+		s.Broadcast(e)
+	}
+}
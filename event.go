@@ -2,9 +2,15 @@ package eventsource
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
+	"unicode/utf16"
 )
 
 // Event holds the structured data for an event.
@@ -12,15 +18,56 @@ import (
 // buffer. The buffer is filled from the working area at the first
 // call to either Read or String. Mutating the event resets the buffer
 // but sequential calls to Read do not.
+//
+// The standard fields are always written in the same order: id, event, data,
+// and finally retry. Custom fields keep their place among them, see
+// WriteField.
+//
+// Read consumes the buffer and supports a single reader only. Bytes does not
+// consume anything, and once the event has been prepared it may be called
+// from several goroutines so long as the event is not mutated.
 type Event struct {
-	id     string
-	data   []string
-	event  string
-	retry  uint64
-	buf    bytes.Buffer
-	bufSet bool
+	id       string
+	data     [][]byte
+	trailing bool
+	event    string
+	retry    uint64
+	hasRetry bool
+	fields   []field
+	compact  bool
+	buf      bytes.Buffer
+	bufSet   bool
+	raw      bool
+	off      int
+
+	// set for the events written together by Client.SendBatch, with the
+	// number of them
+	batch   bool
+	batched int
+}
+
+// A custom field written with WriteField, after the standard field that was
+// last in the wire format when it was added
+type field struct {
+	name  string
+	value string
+	after int
 }
 
+// Places in the wire format custom fields are written, after each of the
+// standard fields in order
+const (
+	afterNone = iota
+	afterID
+	afterEvent
+	afterData
+	afterRetry
+)
+
+// ErrInvalidField is returned by WriteField when the field can not be
+// represented in the wire format
+var ErrInvalidField = errors.New("eventsource: invalid field")
+
 // ID sets the event ID
 func (e *Event) ID(id string) *Event {
 	e.id = id
@@ -36,8 +83,11 @@ func (e *Event) Type(t string) *Event {
 }
 
 // Retry sets the event's retry: field
+// Once set the field is always sent, including a value of 0 which asks the
+// client to reconnect immediately.
 func (e *Event) Retry(t uint64) *Event {
 	e.retry = t
+	e.hasRetry = true
 	e.bufSet = false
 	return e
 }
@@ -46,25 +96,140 @@ func (e *Event) Retry(t uint64) *Event {
 func (e *Event) Data(dat string) *Event {
 	// truncate
 	e.data = e.data[:0]
+	e.trailing = false
 	e.WriteString(dat)
 	return e
 }
 
+// DataLines replaces the data with the given lines, each written as its own
+// data: line. Empty lines are kept as empty data: lines, unlike with Data.
+// A line that itself contains newlines is split into several lines.
+func (e *Event) DataLines(lines []string) *Event {
+	// truncate
+	e.data = e.data[:0]
+	for _, line := range lines {
+		if line == "" {
+			e.data = append(e.data, []byte{})
+			continue
+		}
+		e.appendData([]byte(line), true)
+
+		// each element is a line of its own, so a trailing newline in it
+		// is never joined to the next
+		e.trailing = false
+	}
+	e.bufSet = false
+	return e
+}
+
 // AppendData adds data to the event without overwriting
 func (e *Event) AppendData(dat string) *Event {
 	e.WriteString(dat)
 	return e
 }
 
+// GetID returns the event's id: field
+func (e *Event) GetID() string {
+	return e.id
+}
+
+// GetType returns the event's event: field
+func (e *Event) GetType() string {
+	return e.event
+}
+
+// IsDefaultType returns true if the event has no event: field, or has the
+// default "message" type, so it fires the EventSource's onmessage handler in
+// the browser.
+func (e *Event) IsDefaultType() bool {
+	return e.event == "" || e.event == "message"
+}
+
+// GetData returns a copy of the event's data: lines
+func (e *Event) GetData() []string {
+	data := make([]string, len(e.data))
+	for i, entry := range e.data {
+		data[i] = string(entry)
+	}
+	return data
+}
+
+// GetRetry returns the event's retry: field
+func (e *Event) GetRetry() uint64 {
+	return e.retry
+}
+
+// WriteField adds a field with an arbitrary name to the event.
+// Custom fields keep the order they were added in relative to the standard
+// fields. As those are always written in the order id, event, data and retry,
+// a custom field is written directly after the last of them already set when
+// it was added, or first if none were. Clients ignore fields they do not know.
+// The name must not be empty or contain a colon, and neither the name nor the
+// value may contain newlines or non-ascii characters, otherwise
+// ErrInvalidField is returned.
+func (e *Event) WriteField(name, value string) error {
+	if name == "" || strings.ContainsRune(name, ':') || !validFieldText(name) || !validFieldText(value) {
+		return ErrInvalidField
+	}
+
+	e.fields = append(e.fields, field{name: name, value: value, after: e.lastField()})
+	e.bufSet = false
+	return nil
+}
+
+// Finds the last standard field set in the order of the wire format
+func (e *Event) lastField() int {
+	switch {
+	case e.hasRetry:
+		return afterRetry
+	case len(e.data) > 0:
+		return afterData
+	case len(e.event) > 0:
+		return afterEvent
+	case len(e.id) > 0:
+		return afterID
+	}
+	return afterNone
+}
+
+// Checks field text fits on a single ascii line
+func validFieldText(s string) bool {
+	for _, c := range s {
+		if c == '\n' || c == '\r' || c > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
 // Read the event in wire format
 func (e *Event) Read(p []byte) (int, error) {
-	if e.bufSet {
-		return e.buf.Read(p)
+	if !e.bufSet {
+		e.prepare()
 	}
 
-	e.prepare()
+	wire := e.buf.Bytes()
+	if e.off >= len(wire) {
+		return 0, io.EOF
+	}
 
-	return e.buf.Read(p)
+	n := copy(p, wire[e.off:])
+	e.off += n
+	return n, nil
+}
+
+// Bytes returns the event in wire format.
+// The returned slice is owned by the event and must not be modified. It
+// is valid until the event is next mutated.
+//
+// The first call after a mutation prepares the buffer, so Bytes and String
+// must not be called concurrently with Read or with each other on an event
+// that has not yet been prepared.
+func (e *Event) Bytes() []byte {
+	if !e.bufSet {
+		e.prepare()
+	}
+	return e.buf.Bytes()
 }
 
 // Prepares the data buf for reading
@@ -72,57 +237,131 @@ func (e *Event) prepare() {
 
 	// Wipe out any existing data
 	e.buf.Reset()
-
-	// event:
-	if len(e.event) > 0 {
-		e.buf.WriteString("event: ")
-		e.buf.WriteString(e.event)
-		e.buf.WriteByte('\n')
-	}
+	e.off = 0
+	e.writeFields(afterNone)
 
 	// id:
 	if len(e.id) > 0 {
-		e.buf.WriteString("id: ")
-		e.buf.WriteString(e.id)
-		e.buf.WriteByte('\n')
+		e.writeLine("id", e.id)
 	}
+	e.writeFields(afterID)
+
+	// event:
+	if len(e.event) > 0 {
+		e.writeLine("event", e.event)
+	}
+	e.writeFields(afterEvent)
 
 	// data:
 	if len(e.data) > 0 {
 		for _, entry := range e.data {
-			e.buf.WriteString("data: ")
-			e.buf.WriteString(entry)
+			e.writeName("data", len(entry) > 0 && entry[0] == ' ')
+			e.buf.Write(entry)
 			e.buf.WriteByte('\n')
 		}
 	}
+	e.writeFields(afterData)
 
 	// retry:
-	if e.retry > 0 {
-		e.buf.WriteString("retry: ")
-		e.buf.WriteString(strconv.FormatUint(e.retry, 10))
-		e.buf.WriteByte('\n')
+	if e.hasRetry {
+		e.writeLine("retry", strconv.FormatUint(e.retry, 10))
 	}
+	e.writeFields(afterRetry)
 
 	e.buf.WriteByte('\n')
 	e.bufSet = true
+	e.raw = false
+}
+
+// Writes the custom fields placed after a standard field, in the order they
+// were added
+func (e *Event) writeFields(after int) {
+	for _, f := range e.fields {
+		if f.after == after {
+			e.writeLine(f.name, f.value)
+		}
+	}
+}
+
+// Writes a single field line to the buffer
+func (e *Event) writeLine(name, value string) {
+	e.writeName(name, strings.HasPrefix(value, " "))
+	e.buf.WriteString(value)
+	e.buf.WriteByte('\n')
+}
+
+// Writes the name of a field line and the separator before its value
+func (e *Event) writeName(name string, spacedValue bool) {
+	e.buf.WriteString(name)
+	e.buf.WriteByte(':')
+
+	// the client strips a single space after the colon, so compact lines
+	// still need one when the value starts with a space
+	if !e.compact || spacedValue {
+		e.buf.WriteByte(' ')
+	}
+}
+
+// Compact sets whether the event is written without the optional space after
+// each field's colon, as "data:value" rather than "data: value", for smaller
+// events. Clients read both forms the same.
+func (e *Event) Compact(compact bool) *Event {
+	e.compact = compact
+	e.bufSet = false
+	return e
 }
 
 // Write to the event. Buffer will be converted to one or more
 // `data` sections in wire format
 //
+// Write implements io.Writer, the whole buffer is always consumed and
+// len(p) returned, even though empty lines are not stored.
+//
 // Successive calls to write will each create data entry lines
 //
 // Newlines will be split into multiple data entry lines, successive
-// newlines are discarded
+// newlines are discarded. A trailing newline is kept as part of the data, so
+// "hello\n" is received as "hello\n" rather than "hello", unless more data is
+// written after it, in which case it only separates the lines.
 func (e *Event) Write(p []byte) (int, error) {
-	e.WriteString(string(p))
+	e.AppendBytes(p)
 	return len(p), nil
 }
 
-// WriteString adds string data to the event.
-// Equivalent to calling Write([]byte(string))
+// WriteString adds string data to the event, and implements io.StringWriter.
+// It splits lines and keeps a trailing newline in the same way as Write.
+// The whole string is always consumed, so the count is len(p), even though
+// empty lines are not stored.
 // Panics if provided with non-ascii input
-func (e *Event) WriteString(p string) {
+func (e *Event) WriteString(p string) (int, error) {
+	e.appendData([]byte(p), false)
+	return len(p), nil
+}
+
+// AppendBytes adds data to the event without overwriting, in the same way
+// as AppendData but without converting to a string first.
+// The data is copied, so p may be reused.
+// Panics if provided with non-ascii input
+func (e *Event) AppendBytes(p []byte) *Event {
+	e.appendData(append([]byte(nil), p...), false)
+	return e
+}
+
+// WriteStringPreserveBlanks adds string data to the event like WriteString,
+// but keeps blank lines as empty data lines rather than discarding them, so
+// the client receives exactly the original string.
+// Panics if provided with non-ascii input
+func (e *Event) WriteStringPreserveBlanks(p string) (int, error) {
+	e.appendData([]byte(p), true)
+	return len(p), nil
+}
+
+// Splits data owned by the event into data entry lines, optionally keeping
+// blank lines. Entries are slices of p, which must not be modified afterwards.
+// A trailing newline is kept as a final empty line, after the line before it
+// even if that is blank, so that data of only "\n" still reaches the client.
+// The empty line is dropped again if more data follows.
+func (e *Event) appendData(p []byte, keepBlank bool) {
 	// check ASCII
 	for _, c := range p {
 		if c > unicode.MaxASCII {
@@ -131,41 +370,209 @@ func (e *Event) WriteString(p string) {
 			panic("eventsource: WriteString: Attempt to write non-ascii string")
 		}
 	}
+	if len(p) == 0 {
+		return
+	}
+
+	// the newline ending the data written before only separated it from
+	// this data
+	if e.trailing {
+		e.data = e.data[:len(e.data)-1]
+		e.trailing = false
+	}
+
+	// a trailing newline is followed by one more blank line
+	trailingBlank := p[len(p)-1] == '\n'
+
 	// split event on newlines
-	split := strings.Split(p, "\n")
-	for _, entry := range split {
-		// don't write empty entries
-		if len(entry) == 0 {
+	for len(p) > 0 {
+		var entry []byte
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			entry, p = p[:i], p[i+1:]
+		} else {
+			entry, p = p, nil
+		}
+
+		// don't write empty entries unless asked to, or the newline after
+		// them would be lost
+		if len(entry) == 0 && !keepBlank && !(trailingBlank && len(p) == 0) {
 			continue
 		}
-		e.data = append(e.data, entry)
+		// cap the entry so appending to it can never touch the next one
+		e.data = append(e.data, entry[:len(entry):len(entry)])
+	}
+	if trailingBlank {
+		e.data = append(e.data, []byte{})
+		e.trailing = true
 	}
 	e.bufSet = false
 }
 
+// WriteJSON marshals v as JSON and adds it as data to the event.
+// Any non-ascii characters in the output are escaped so the result is
+// always safe to send. Marshalling errors are returned and leave the event
+// unchanged.
+func (e *Event) WriteJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.appendData(asciiJSON(b), false)
+	return nil
+}
+
+// Escapes any non-ascii characters in a JSON document. Non-ascii characters
+// may only occur inside JSON strings, where a \u escape is equivalent.
+func asciiJSON(b []byte) []byte {
+	var out bytes.Buffer
+	for _, r := range string(b) {
+		if r <= unicode.MaxASCII {
+			out.WriteRune(r)
+			continue
+		}
+		if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar {
+			fmt.Fprintf(&out, "\\u%04x\\u%04x", r1, r2)
+			continue
+		}
+		fmt.Fprintf(&out, "\\u%04x", r)
+	}
+	return out.Bytes()
+}
+
 // WriteRaw sets an event directly in wire format
 //
 // This does no validation to ensure it is in a correct format
 // and should mostly be used to deep copy another event
 func (e *Event) WriteRaw(p []byte) (int, error) {
 	e.bufSet = true
+	e.raw = true
 	return e.buf.Write(p)
 }
 
+// Size returns the length of the Event in wire format, including the prefix
+// of every line and the blank line ending the event.
+// It prepares the event in the same way as Bytes, and is subject to the same
+// concurrency rules.
+func (e *Event) Size() int {
+	return len(e.Bytes())
+}
+
 // String returns the Event in wire format as a string
+// It is equivalent to string(e.Bytes()) and is subject to the same
+// concurrency rules.
 func (e *Event) String() string {
-	e.prepare()
-	return string(e.buf.Bytes())
+	return string(e.Bytes())
 }
 
 // Clone returns a deep copy of the event
+//
+// Only the working fields are copied. The clone does not share the wire
+// buffer of the original and will be prepared fresh on its first Read or
+// String, so later mutations of the original do not affect it.
+// Events set with WriteRaw have no working fields, so their wire format is
+// copied instead.
 func (e *Event) Clone() *Event {
 	clone := &Event{
-		id:    e.id,
-		event: e.event,
-		retry: e.retry,
+		id:       e.id,
+		event:    e.event,
+		retry:    e.retry,
+		hasRetry: e.hasRetry,
+		compact:  e.compact,
 	}
 
 	clone.data = append(clone.data, e.data...)
+	clone.trailing = e.trailing
+	clone.fields = append(clone.fields, e.fields...)
+
+	if e.raw && e.bufSet {
+		clone.buf.Write(e.buf.Bytes())
+		clone.bufSet = true
+		clone.raw = true
+	}
 	return clone
 }
+
+// Equal reports whether two events are logically the same, comparing their
+// id, type, retry, custom fields and data regardless of how they were built or
+// the state of their buffers. Data is compared as the joined string the client
+// would receive.
+func (e *Event) Equal(other *Event) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+
+	if e.id != other.id || e.event != other.event ||
+		e.hasRetry != other.hasRetry || e.retry != other.retry {
+		return false
+	}
+
+	if len(e.fields) != len(other.fields) {
+		return false
+	}
+	for i := range e.fields {
+		if e.fields[i] != other.fields[i] {
+			return false
+		}
+	}
+
+	return bytes.Equal(bytes.Join(e.data, []byte{'\n'}), bytes.Join(other.data, []byte{'\n'}))
+}
+
+// Returns the number of events written when e is sent, which for a batch is
+// each of the events in it
+func (e *Event) count() int {
+	if e.batch {
+		return e.batched
+	}
+	return 1
+}
+
+// Reset clears the event so that it may be reused
+// The capacity of the working memory and buffer is kept.
+func (e *Event) Reset() {
+	e.id = ""
+	e.event = ""
+	e.data = e.data[:0]
+	e.trailing = false
+	e.retry = 0
+	e.hasRetry = false
+	e.fields = e.fields[:0]
+	e.compact = false
+	e.buf.Reset()
+	e.bufSet = false
+	e.raw = false
+	e.off = 0
+	e.batch = false
+	e.batched = 0
+}
+
+var eventPool = sync.Pool{
+	New: func() interface{} {
+		return &Event{}
+	},
+}
+
+// GetEvent returns an empty event from a shared pool
+// Return it with PutEvent once it is no longer needed to reduce allocations.
+func GetEvent() *Event {
+	return eventPool.Get().(*Event)
+}
+
+// PutEvent resets an event and returns it to the shared pool
+// The event must not be used afterwards. Events passed to Send, Broadcast
+// or Publish are copied, so they may be returned as soon as those calls do.
+func PutEvent(e *Event) {
+	e.Reset()
+	eventPool.Put(e)
+}
+
+// share returns a prepared copy of the event that may be handed to several
+// clients at once. The copy must never be mutated, and is only ever read
+// from its prepared buffer.
+func (e *Event) share() *Event {
+	shared := e.Clone()
+	if !shared.bufSet {
+		shared.prepare()
+	}
+	return shared
+}
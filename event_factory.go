@@ -3,6 +3,7 @@ package eventsource
 import (
 	"io"
 	"strconv"
+	"sync/atomic"
 )
 
 // EventFactory is a type of object that can create new events
@@ -10,16 +11,27 @@ type EventFactory interface {
 	New() *Event
 }
 
+// EventMarshaler is implemented by types that can render themselves as events
+type EventMarshaler interface {
+	MarshalEvent() (*Event, error)
+}
+
 // EventIDFactory is an event factory that creates events with
 // sequential ID fields.
 // If NewFunc is set, the factory uses it to create events before setting
 // their IDs
-// If NewFunc is not set, NewFact will be used. If neither is set, a new
-// event is created from scratch
+// If NewFunc is not set, NewFact will be used. If neither is set, an empty
+// event is taken from the shared pool
+// IDs are formatted as decimal numbers unless Format is set.
+// The factory is safe to use from several goroutines, so long as Next is only
+// modified before it is shared. To resume a sequence after a restart, save the
+// value from Peek and set it as Next.
 type EventIDFactory struct {
+	// first for 64 bit alignment of atomic operations
+	Next    uint64
 	NewFact EventFactory
 	NewFunc func() *Event
-	Next    uint64
+	Format  func(uint64) string
 }
 
 // New creates an event with the Next id in the sequence
@@ -30,14 +42,29 @@ func (f *EventIDFactory) New() *Event {
 	} else if f.NewFact != nil {
 		e = f.NewFact.New()
 	} else {
-		e = &Event{}
+		e = GetEvent()
 	}
 
-	e.id = strconv.FormatUint(f.Next, 10)
-	f.Next++
+	f.Apply(e)
 	return e
 }
 
+// Apply sets the Next id in the sequence on an existing event
+// It may be used as a decorator in a FactoryChain.
+func (f *EventIDFactory) Apply(e *Event) {
+	next := atomic.AddUint64(&f.Next, 1) - 1
+	if f.Format != nil {
+		e.ID(f.Format(next))
+	} else {
+		e.ID(strconv.FormatUint(next, 10))
+	}
+}
+
+// Peek returns the Next value in the sequence without using it
+func (f *EventIDFactory) Peek() uint64 {
+	return atomic.LoadUint64(&f.Next)
+}
+
 // EventTypeFactory creates events of a specific type
 type EventTypeFactory struct {
 	NewFact EventFactory
@@ -48,8 +75,8 @@ type EventTypeFactory struct {
 // New creates an event with the event type set
 // If NewFunc is set, the factory uses it to create events before setting
 // their event types
-// If NewFunc is not set, NewFact will be used. If neither is set, a new
-// event is created from scratch
+// If NewFunc is not set, NewFact will be used. If neither is set, an empty
+// event is taken from the shared pool
 func (f *EventTypeFactory) New() *Event {
 	var e *Event
 	if f.NewFunc != nil {
@@ -57,10 +84,83 @@ func (f *EventTypeFactory) New() *Event {
 	} else if f.NewFact != nil {
 		e = f.NewFact.New()
 	} else {
-		e = &Event{}
+		e = GetEvent()
 	}
 
-	e.event = f.Type
+	f.Apply(e)
+	return e
+}
+
+// Apply sets the event type on an existing event
+// It may be used as a decorator in a FactoryChain.
+func (f *EventTypeFactory) Apply(e *Event) {
+	e.Type(f.Type)
+}
+
+// EventRetryFactory creates events with a retry directive
+type EventRetryFactory struct {
+	NewFact EventFactory
+	NewFunc func() *Event
+	Retry   uint64
+}
+
+// New creates an event with the retry field set
+// If NewFunc is set, the factory uses it to create events before setting
+// their retry fields
+// If NewFunc is not set, NewFact will be used. If neither is set, an empty
+// event is taken from the shared pool
+func (f *EventRetryFactory) New() *Event {
+	var e *Event
+	if f.NewFunc != nil {
+		e = f.NewFunc()
+	} else if f.NewFact != nil {
+		e = f.NewFact.New()
+	} else {
+		e = GetEvent()
+	}
+
+	f.Apply(e)
+	return e
+}
+
+// Apply sets the retry field on an existing event
+// It may be used as a decorator in a FactoryChain.
+func (f *EventRetryFactory) Apply(e *Event) {
+	e.Retry(f.Retry)
+}
+
+// FactoryChain creates events from a base factory and then passes them
+// through each decorator in order, each receiving the event produced so far.
+// If Base is not set, an empty event is taken from the shared pool
+type FactoryChain struct {
+	Base       EventFactory
+	Decorators []func(*Event)
+}
+
+// ChainFactories creates a FactoryChain from a base factory and decorators.
+// The Apply methods of the other factories may be used as decorators, for
+// example
+//
+//	ChainFactories(nil, ids.Apply, types.Apply, func(e *Event) { e.Retry(5000) })
+func ChainFactories(base EventFactory, decorators ...func(*Event)) *FactoryChain {
+	return &FactoryChain{
+		Base:       base,
+		Decorators: decorators,
+	}
+}
+
+// New creates an event and applies every decorator to it in order
+func (f *FactoryChain) New() *Event {
+	var e *Event
+	if f.Base != nil {
+		e = f.Base.New()
+	} else {
+		e = GetEvent()
+	}
+
+	for _, decorate := range f.Decorators {
+		decorate(e)
+	}
 	return e
 }
 
@@ -71,7 +171,25 @@ func DataEvent(data string) *Event {
 	return e
 }
 
-// TypeEvent creates a new Event with the event field set
+// MessageEvent creates a new Event with the data field set and no event
+// field, so it has the default "message" type. In the browser it fires the
+// EventSource's onmessage handler.
+func MessageEvent(data string) *Event {
+	return DataEvent(data)
+}
+
+// JSONEvent creates a new Event with the data field set to v marshalled as JSON
+func JSONEvent(v interface{}) (*Event, error) {
+	e := &Event{}
+	if err := e.WriteJSON(v); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// TypeEvent creates a new Event with the event field set.
+// In the browser, named events do not fire the EventSource's onmessage
+// handler, they must be listened for with addEventListener.
 func TypeEvent(t string) *Event {
 	return &Event{
 		event: t,
@@ -0,0 +1,156 @@
+package eventsource
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEventIDFactoryConcurrent(t *testing.T) {
+	const goroutines, each = 16, 500
+	f := &EventIDFactory{Next: 1}
+
+	ids := make(chan string, goroutines*each)
+	var wait sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < each; i++ {
+				ids <- f.New().GetID()
+			}
+		}()
+	}
+	wait.Wait()
+	close(ids)
+
+	seen := make(map[uint64]bool)
+	for id := range ids {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid id %q", id)
+		}
+		if seen[n] {
+			t.Errorf("duplicate id %d", n)
+		}
+		seen[n] = true
+	}
+	for n := uint64(1); n <= goroutines*each; n++ {
+		if !seen[n] {
+			t.Errorf("missing id %d", n)
+		}
+	}
+	if next := f.Peek(); next != goroutines*each+1 {
+		t.Errorf("want next id %d, got %d", goroutines*each+1, next)
+	}
+}
+
+func TestEventIDFactoryFormat(t *testing.T) {
+	f := &EventIDFactory{
+		Next: 254,
+		Format: func(n uint64) string {
+			return "0x" + strconv.FormatUint(n, 16)
+		},
+	}
+
+	for _, want := range []string{"0xfe", "0xff", "0x100"} {
+		if got := f.New().GetID(); got != want {
+			t.Errorf("want id %q, got %q", want, got)
+		}
+	}
+}
+
+func TestEventIDFactoryResume(t *testing.T) {
+	first := &EventIDFactory{}
+	first.New()
+	first.New()
+	saved := first.Peek()
+
+	resumed := &EventIDFactory{Next: saved}
+	if got, want := resumed.New().GetID(), "2"; got != want {
+		t.Errorf("want resumed id %q, got %q", want, got)
+	}
+}
+
+func TestChainFactories(t *testing.T) {
+	ids := &EventIDFactory{Next: 1}
+	types := &EventTypeFactory{Type: "update"}
+
+	var order []string
+	chain := ChainFactories(nil,
+		ids.Apply,
+		types.Apply,
+		func(e *Event) {
+			// each decorator sees the event produced so far
+			order = append(order, e.GetID()+"/"+e.GetType())
+			e.Retry(3000)
+		},
+	)
+
+	for i, want := range []string{
+		"id: 1\nevent: update\nretry: 3000\n\n",
+		"id: 2\nevent: update\nretry: 3000\n\n",
+	} {
+		if got := chain.New().String(); got != want {
+			t.Errorf("event %d: want %q, got %q", i, want, got)
+		}
+	}
+	if got, want := strings.Join(order, ","), "1/update,2/update"; got != want {
+		t.Errorf("decorators saw %q, want %q", got, want)
+	}
+}
+
+func TestChainFactoriesBase(t *testing.T) {
+	chain := ChainFactories(factoryFunc(func() *Event {
+		return DataEvent("base")
+	}), (&EventTypeFactory{Type: "wrapped"}).Apply)
+
+	if got, want := chain.New().String(), "event: wrapped\ndata: base\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// Adapts a function to an EventFactory
+type factoryFunc func() *Event
+
+func (f factoryFunc) New() *Event {
+	return f()
+}
+
+func TestEventRetryFactory(t *testing.T) {
+	f := &EventRetryFactory{Retry: 2500}
+	if got, want := f.New().String(), "retry: 2500\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestEventRetryFactoryInner(t *testing.T) {
+	inner := &EventTypeFactory{
+		Type: "ping",
+		NewFunc: func() *Event {
+			return (&Event{}).ID("inner").Data("kept")
+		},
+	}
+
+	for _, f := range []*EventRetryFactory{
+		{Retry: 0, NewFact: inner},
+		{Retry: 0, NewFunc: inner.New},
+	} {
+		if got, want := f.New().String(), "id: inner\nevent: ping\ndata: kept\nretry: 0\n\n"; got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestEventRetryFactoryPrefersNewFunc(t *testing.T) {
+	f := &EventRetryFactory{
+		Retry:   10,
+		NewFact: &EventTypeFactory{Type: "fact"},
+		NewFunc: func() *Event { return TypeEvent("func") },
+	}
+
+	if got, want := f.New().GetType(), "func"; got != want {
+		t.Errorf("want type %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,725 @@
+package eventsource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCloneIndependentOfOriginal(t *testing.T) {
+	e := (&Event{}).ID("1").Type("greeting").Retry(500)
+	e.Data("hello\nworld")
+
+	want := e.String()
+	clone := e.Clone()
+
+	e.ID("2").Type("changed").Retry(10)
+	e.Data("mutated")
+	e.AppendData("more")
+
+	if got := clone.String(); got != want {
+		t.Errorf("clone changed with original\nwant %q\n got %q", want, got)
+	}
+	if got := e.String(); got == want {
+		t.Errorf("original unchanged after mutation: %q", got)
+	}
+}
+
+func TestCloneCopiesRetry(t *testing.T) {
+	e := (&Event{}).Retry(0)
+
+	if got, want := e.Clone().String(), "retry: 0\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCloneDoesNotSharePreparedBuffer(t *testing.T) {
+	e := DataEvent("before")
+	e.Bytes()
+
+	clone := e.Clone()
+	e.Data("after")
+	e.Bytes()
+
+	if got, want := clone.String(), "data: before\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCloneRawEvent(t *testing.T) {
+	e := &Event{}
+	e.WriteRaw([]byte("data: raw\n\n"))
+
+	clone := e.Clone()
+	e.WriteRaw([]byte("data: extra\n\n"))
+
+	if got, want := clone.String(), "data: raw\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStringMatchesBytes(t *testing.T) {
+	e := (&Event{}).ID("7").Type("update").Retry(100)
+	e.Data("one\ntwo")
+
+	want := "id: 7\nevent: update\ndata: one\ndata: two\nretry: 100\n\n"
+	if got := string(e.Bytes()); got != want {
+		t.Errorf("Bytes: want %q, got %q", want, got)
+	}
+	if got := e.String(); got != want {
+		t.Errorf("String: want %q, got %q", want, got)
+	}
+}
+
+func TestBytesIdempotent(t *testing.T) {
+	e := DataEvent("repeat")
+
+	first := e.String()
+	for i := 0; i < 3; i++ {
+		if got := e.String(); got != first {
+			t.Errorf("String call %d: want %q, got %q", i, first, got)
+		}
+		if got := string(e.Bytes()); got != first {
+			t.Errorf("Bytes call %d: want %q, got %q", i, first, got)
+		}
+	}
+}
+
+func TestBytesReflectsMutation(t *testing.T) {
+	e := DataEvent("before")
+	e.Bytes()
+	e.Data("after")
+
+	if got, want := e.String(), "data: after\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRetryZero(t *testing.T) {
+	e := (&Event{}).Retry(0)
+	e.Data("now")
+
+	if got, want := e.String(), "data: now\nretry: 0\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestNoRetryUnlessSet(t *testing.T) {
+	e := DataEvent("later")
+
+	if got := e.String(); strings.Contains(got, "retry:") {
+		t.Errorf("unexpected retry line in %q", got)
+	}
+}
+
+type jsonInner struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+type jsonOuter struct {
+	ID    int         `json:"id"`
+	Inner jsonInner   `json:"inner"`
+	Items []jsonInner `json:"items"`
+}
+
+var jsonValue = jsonOuter{
+	ID:    42,
+	Inner: jsonInner{Name: "inner", Tags: []string{"a", "b"}},
+	Items: []jsonInner{{Name: "first"}, {Name: "second\nline", Tags: []string{"c"}}},
+}
+
+// Reassembles the data lines of an event as the receiving end would
+func receivedData(e *Event) string {
+	return strings.Join(e.GetData(), "\n")
+}
+
+func TestJSONEvent(t *testing.T) {
+	e, err := JSONEvent(jsonValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got jsonOuter
+	if err := json.Unmarshal([]byte(receivedData(e)), &got); err != nil {
+		t.Fatalf("received invalid JSON %q: %v", receivedData(e), err)
+	}
+	if !reflect.DeepEqual(got, jsonValue) {
+		t.Errorf("want %+v, got %+v", jsonValue, got)
+	}
+}
+
+func TestWriteJSONIndentedData(t *testing.T) {
+	indented, err := json.MarshalIndent(jsonValue, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Event{}
+	e.AppendBytes(indented)
+	if len(e.GetData()) < 2 {
+		t.Fatalf("indented JSON not split into data lines: %q", e.String())
+	}
+
+	var got jsonOuter
+	if err := json.Unmarshal([]byte(receivedData(e)), &got); err != nil {
+		t.Fatalf("received invalid JSON %q: %v", receivedData(e), err)
+	}
+	if !reflect.DeepEqual(got, jsonValue) {
+		t.Errorf("want %+v, got %+v", jsonValue, got)
+	}
+}
+
+func TestWriteJSONBuilder(t *testing.T) {
+	e := (&Event{}).Type("update")
+	if err := e.WriteJSON([]int{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := e.String(), "event: update\ndata: [1,2,3]\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWriteJSONEscapesNonASCII(t *testing.T) {
+	e := &Event{}
+	if err := e.WriteJSON("héllo 😀"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	if err := json.Unmarshal([]byte(receivedData(e)), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != "héllo 😀" {
+		t.Errorf("want %q, got %q", "héllo 😀", got)
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	e := DataEvent("kept")
+	if err := e.WriteJSON(make(chan int)); err == nil {
+		t.Error("want an error marshalling a channel")
+	}
+	if got, want := e.String(), "data: kept\n\n"; got != want {
+		t.Errorf("failed marshal changed the event: want %q, got %q", want, got)
+	}
+
+	if _, err := JSONEvent(func() {}); err == nil {
+		t.Error("want an error marshalling a function")
+	}
+}
+
+func TestReset(t *testing.T) {
+	e := (&Event{}).ID("1").Type("t").Retry(5).Compact(true)
+	e.Data("data")
+	e.WriteField("custom", "value")
+	e.Bytes()
+
+	e.Reset()
+	if got := e.String(); got != "\n" {
+		t.Errorf("want an empty event, got %q", got)
+	}
+	if !e.Equal(&Event{}) {
+		t.Error("reset event differs from a new event")
+	}
+
+	e.Data("reused")
+	if got, want := e.String(), "data: reused\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPutEventResets(t *testing.T) {
+	e := GetEvent()
+	e.ID("pooled").Data("data")
+	PutEvent(e)
+
+	if got := GetEvent().String(); got != "\n" {
+		t.Errorf("want an empty event from the pool, got %q", got)
+	}
+}
+
+// Broadcasting events taken from the pool and returned after each broadcast
+func BenchmarkBroadcastPooledEvents(b *testing.B) {
+	s := NewStream()
+	discardClients(s, 10)
+	defer s.Shutdown()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		e := GetEvent()
+		e.ID("1234").Type("update")
+		e.WriteString("a reasonably sized payload for every client")
+		s.Broadcast(e)
+		PutEvent(e)
+	}
+}
+
+// Broadcasting a freshly constructed event each time
+func BenchmarkBroadcastFreshEvents(b *testing.B) {
+	s := NewStream()
+	discardClients(s, 10)
+	defer s.Shutdown()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		e := &Event{}
+		e.ID("1234").Type("update")
+		e.WriteString("a reasonably sized payload for every client")
+		s.Broadcast(e)
+	}
+}
+
+func TestWriteFieldOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		build func() *Event
+		want  string
+	}{
+		{"before everything", func() *Event {
+			e := &Event{}
+			e.WriteField("first", "1")
+			e.ID("id").Type("type").Data("data")
+			return e
+		}, "first: 1\nid: id\nevent: type\ndata: data\n\n"},
+
+		{"after id", func() *Event {
+			e := (&Event{}).ID("id")
+			e.WriteField("a", "1")
+			e.WriteField("b", "2")
+			e.Type("type").Data("data")
+			return e
+		}, "id: id\na: 1\nb: 2\nevent: type\ndata: data\n\n"},
+
+		{"after event", func() *Event {
+			e := (&Event{}).ID("id").Type("type")
+			e.WriteField("custom", "value")
+			e.Data("data")
+			return e
+		}, "id: id\nevent: type\ncustom: value\ndata: data\n\n"},
+
+		{"after data", func() *Event {
+			e := (&Event{}).ID("id").Data("one\ntwo")
+			e.WriteField("custom", "value")
+			e.Retry(10)
+			return e
+		}, "id: id\ndata: one\ndata: two\ncustom: value\nretry: 10\n\n"},
+
+		{"after retry", func() *Event {
+			e := (&Event{}).Data("data").Retry(10)
+			e.WriteField("last", "value")
+			return e
+		}, "data: data\nretry: 10\nlast: value\n\n"},
+
+		{"interleaved", func() *Event {
+			e := &Event{}
+			e.WriteField("a", "1")
+			e.ID("id")
+			e.WriteField("b", "2")
+			e.Data("data")
+			e.WriteField("c", "3")
+			e.WriteField("d", "4")
+			return e
+		}, "a: 1\nid: id\nb: 2\ndata: data\nc: 3\nd: 4\n\n"},
+
+		{"standard fields keep their order", func() *Event {
+			e := (&Event{}).Data("data")
+			e.WriteField("custom", "value")
+			e.ID("id")
+			return e
+		}, "id: id\ndata: data\ncustom: value\n\n"},
+	} {
+		if got := tc.build().String(); got != tc.want {
+			t.Errorf("%s:\nwant %q\n got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestWriteFieldValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+		ok          bool
+	}{
+		{"custom", "value", true},
+		{"x-trace", "", true},
+		{"", "value", false},
+		{"bad:name", "value", false},
+		{"bad\nname", "value", false},
+		{"name", "bad\nvalue", false},
+		{"name", "bad\rvalue", false},
+		{"naïve", "value", false},
+		{"name", "naïve", false},
+	} {
+		e := DataEvent("data")
+		err := e.WriteField(tc.name, tc.value)
+		if tc.ok && err != nil {
+			t.Errorf("%q: %q: unexpected error %v", tc.name, tc.value, err)
+		}
+		if !tc.ok {
+			if err != ErrInvalidField {
+				t.Errorf("%q: %q: want %v, got %v", tc.name, tc.value, ErrInvalidField, err)
+			}
+			if got := e.String(); got != "data: data\n\n" {
+				t.Errorf("%q: %q: invalid field changed the event to %q", tc.name, tc.value, got)
+			}
+		}
+	}
+}
+
+func TestWriteFieldSurvivesClone(t *testing.T) {
+	e := (&Event{}).ID("id")
+	e.WriteField("custom", "value")
+	e.Data("data")
+
+	if got, want := e.Clone().String(), e.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFieldOrderWireFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		event *Event
+		want  string
+	}{
+		{"all fields", (&Event{}).Retry(3000).Data("payload").Type("update").ID("42"),
+			"id: 42\nevent: update\ndata: payload\nretry: 3000\n\n"},
+		{"type before id", TypeEvent("update").ID("42"),
+			"id: 42\nevent: update\n\n"},
+		{"data before id", DataEvent("payload").ID("42"),
+			"id: 42\ndata: payload\n\n"},
+		{"retry before event", (&Event{}).Retry(0).Type("update"),
+			"event: update\nretry: 0\n\n"},
+		{"multi-line data", (&Event{}).Data("one\ntwo").ID("1"),
+			"id: 1\ndata: one\ndata: two\n\n"},
+		{"empty event", &Event{}, "\n"},
+	} {
+		if got := tc.event.String(); got != tc.want {
+			t.Errorf("%s:\nwant %q\n got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestFieldOrderRoundTrip(t *testing.T) {
+	e := (&Event{}).ID("42").Type("update").Retry(3000)
+	e.WriteField("custom", "value")
+	e.Data("one\ntwo")
+
+	decoded, err := NewDecoder(strings.NewReader(e.String())).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decoded.String(), e.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if !decoded.Equal(e) {
+		t.Errorf("decoded event %q differs from %q", decoded, e)
+	}
+}
+
+func TestAppendBytesCopies(t *testing.T) {
+	p := []byte("original\nlines")
+	e := (&Event{}).AppendBytes(p)
+	copy(p, "modified")
+
+	if got, want := e.String(), "data: original\ndata: lines\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWriteStringPreserveBlanksRoundTrip(t *testing.T) {
+	for _, data := range []string{
+		"line1\n\nline3",
+		"\nleading",
+		"trailing\n\n",
+		"a\n\n\n\nb",
+		"\n",
+	} {
+		e := &Event{}
+		e.WriteStringPreserveBlanks(data)
+
+		decoded, err := NewDecoder(strings.NewReader(e.String())).Decode()
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		if got := strings.Join(decoded.GetData(), "\n"); got != data {
+			t.Errorf("want %q, got %q from %q", data, got, e.String())
+		}
+	}
+}
+
+func TestWriteStringDiscardsBlanks(t *testing.T) {
+	e := &Event{}
+	e.WriteString("line1\n\nline3")
+
+	if got, want := e.String(), "data: line1\ndata: line3\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestDataLines(t *testing.T) {
+	for _, tc := range []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"a", "b"}, "data: a\ndata: b\n\n"},
+		// empty lines are kept, unlike with Data
+		{[]string{"a", "", "b"}, "data: a\ndata: \ndata: b\n\n"},
+		{[]string{""}, "data: \n\n"},
+		// embedded newlines split into more lines
+		{[]string{"a\nb", "c"}, "data: a\ndata: b\ndata: c\n\n"},
+	} {
+		e := (&Event{}).DataLines(tc.lines)
+		if got := e.String(); got != tc.want {
+			t.Errorf("%q: want %q, got %q", tc.lines, tc.want, got)
+		}
+	}
+}
+
+func TestDataLinesReplacesData(t *testing.T) {
+	// prepare the old data first, so replacing it must reset the buffer
+	e := DataEvent("old")
+	e.Bytes()
+	e.DataLines([]string{"new"})
+
+	if got, want := e.String(), "data: new\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestMessageEvent(t *testing.T) {
+	e := MessageEvent("hi")
+	if got, want := e.String(), "data: hi\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if !e.IsDefaultType() {
+		t.Error("want a message event to have the default type")
+	}
+}
+
+func TestIsDefaultType(t *testing.T) {
+	for _, tc := range []struct {
+		event *Event
+		want  bool
+	}{
+		{&Event{}, true},
+		{DataEvent("a"), true},
+		{TypeEvent("message"), true},
+		{TypeEvent("update"), false},
+		{DataEvent("a").Type("Message"), false},
+	} {
+		if got := tc.event.IsDefaultType(); got != tc.want {
+			t.Errorf("%q: want %v, got %v", tc.event, tc.want, got)
+		}
+	}
+}
+
+func TestWriteStringTrailingNewline(t *testing.T) {
+	e := &Event{}
+	e.WriteString("hello\n")
+	if got, want := e.String(), "data: hello\ndata: \n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// the client receives the newline as part of the data
+	decoded, err := NewDecoder(strings.NewReader(e.String())).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(decoded.GetData(), "\n"); got != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+}
+
+func TestTrailingNewlineSameForEveryWrite(t *testing.T) {
+	const data = "hello\nworld\n"
+	writes := map[string]func(e *Event){
+		"Write":       func(e *Event) { e.Write([]byte(data)) },
+		"WriteString": func(e *Event) { e.WriteString(data) },
+		"Data":        func(e *Event) { e.Data(data) },
+		"Fprint":      func(e *Event) { fmt.Fprint(e, data) },
+		"CopyString":  func(e *Event) { io.Copy(e, strings.NewReader(data)) },
+		"CopyBytes":   func(e *Event) { io.Copy(e, bytes.NewReader([]byte(data))) },
+		// split at the newlines, the chunks still join into the same data
+		"Chunks": func(e *Event) {
+			e.Write([]byte("hello\n"))
+			e.WriteString("world\n")
+		},
+	}
+	for name, write := range writes {
+		e := &Event{}
+		write(e)
+		if got, want := e.String(), "data: hello\ndata: world\ndata: \n\n"; got != want {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestTrailingNewlineReceived(t *testing.T) {
+	for _, data := range []string{"\n", "hello\n"} {
+		e := DataEvent(data)
+
+		// a single empty data line would be dropped by the browser
+		decoded, err := NewDecoder(strings.NewReader(e.String())).Decode()
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		if got := strings.Join(decoded.GetData(), "\n"); got != data {
+			t.Errorf("want %q, got %q from %q", data, got, e.String())
+		}
+	}
+}
+
+func TestDataLinesKeepTrailingNewline(t *testing.T) {
+	e := (&Event{}).DataLines([]string{"a\n", "b"})
+	if got, want := e.String(), "data: a\ndata: \ndata: b\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	e := (&Event{}).ID("1").Type("t").Data("a\n b").Retry(10).Compact(true)
+	e.WriteField("x", "y")
+	want := "id:1\nevent:t\ndata:a\ndata:  b\nretry:10\nx:y\n\n"
+	if got := e.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// a value starting with a space keeps the separator, as the client strips
+	// only one space
+	decoded, err := NewDecoder(strings.NewReader(e.String())).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(decoded.GetData(), "\n"); got != "a\n b" {
+		t.Errorf("want %q, got %q", "a\n b", got)
+	}
+
+	if got := e.Clone().String(); got != want {
+		t.Errorf("clone: want %q, got %q", want, got)
+	}
+	e.Compact(false)
+	if got := e.String(); !strings.HasPrefix(got, "id: 1\n") {
+		t.Errorf("want the spaced form again, got %q", got)
+	}
+}
+
+func TestCopyIntoEvent(t *testing.T) {
+	src := "first\nsecond\n\nthird"
+
+	// hide WriteTo so that the copy goes through Write
+	e := &Event{}
+	n, err := io.Copy(e, struct{ io.Reader }{strings.NewReader(src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(src)) {
+		t.Errorf("want %d bytes copied, got %d", len(src), n)
+	}
+	if got, want := e.String(), "data: first\ndata: second\ndata: third\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWriteStringCount(t *testing.T) {
+	var w io.StringWriter = &Event{}
+
+	n, err := w.WriteString("one\n\ntwo\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len("one\n\ntwo\n") {
+		t.Errorf("want %d, got %d", len("one\n\ntwo\n"), n)
+	}
+}
+
+func TestEqualAcrossConstruction(t *testing.T) {
+	appended := (&Event{}).ID("1").Type("update").AppendData("one").AppendData("two")
+	joined := (&Event{}).Type("update").ID("1").Data("one\ntwo")
+	// preparing the buffer doesn't change the event
+	joined.Bytes()
+
+	if !appended.Equal(joined) || !joined.Equal(appended) {
+		t.Errorf("want %q equal to %q", appended, joined)
+	}
+	if !appended.Equal(appended.Clone()) {
+		t.Error("want an event equal to its clone")
+	}
+}
+
+func TestEqualDiffers(t *testing.T) {
+	base := func() *Event {
+		return (&Event{}).ID("1").Type("update").Retry(100).Data("one\ntwo")
+	}
+
+	for name, e := range map[string]*Event{
+		"id":    base().ID("2"),
+		"type":  base().Type("other"),
+		"retry": base().Retry(200),
+		"data":  base().Data("one two"),
+		"field": func() *Event { e := base(); e.WriteField("x", "y"); return e }(),
+		"nil":   nil,
+	} {
+		if base().Equal(e) {
+			t.Errorf("%s: want %q not equal to %q", name, e, base())
+		}
+	}
+
+	var none *Event
+	if !none.Equal(nil) {
+		t.Error("want nil events equal")
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, tc := range []struct {
+		event *Event
+		size  int
+	}{
+		{&Event{}, 1},
+		{DataEvent("a"), len("data: a\n\n")},
+		// every data line has its own prefix
+		{DataEvent("a\nb\nc"), len("data: a\ndata: b\ndata: c\n\n")},
+		{DataEvent("a").ID("1").Type("t").Retry(10), len("id: 1\nevent: t\ndata: a\nretry: 10\n\n")},
+	} {
+		if got := tc.event.Size(); got != tc.size {
+			t.Errorf("%q: want %d, got %d", tc.event, tc.size, got)
+		}
+	}
+}
+
+// A large payload of many lines
+var largePayload = []byte(strings.Repeat(strings.Repeat("x", 79)+"\n", 1024))
+
+// Writing bytes splits them in place without converting to a string
+func BenchmarkWriteLargeBytes(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(largePayload)))
+
+	for i := 0; i < b.N; i++ {
+		e := &Event{}
+		e.Write(largePayload)
+		e.Bytes()
+	}
+}
+
+// Converting the bytes to a string first, as Write used to, costs another copy
+func BenchmarkWriteLargeString(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(largePayload)))
+
+	for i := 0; i < b.N; i++ {
+		e := &Event{}
+		e.WriteString(string(largePayload))
+		e.Bytes()
+	}
+}
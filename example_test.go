@@ -0,0 +1,27 @@
+package eventsource_test
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/AndrewBurian/eventsource/v2"
+)
+
+// Capturing the events broadcast to a client, for example in a unit test
+func ExampleNewClientWriter() {
+	var buf bytes.Buffer
+	stream := eventsource.NewStream()
+	stream.Register(eventsource.NewClientWriter(&buf))
+
+	stream.Broadcast(eventsource.DataEvent("hello"))
+	stream.Broadcast((&eventsource.Event{}).Type("update").Data("world"))
+
+	// shutting down waits for every event to be written
+	stream.Shutdown()
+	fmt.Print(buf.String())
+	// Output:
+	// data: hello
+	//
+	// event: update
+	// data: world
+}
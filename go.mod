@@ -1 +1,3 @@
 module github.com/AndrewBurian/eventsource/v2
+
+go 1.20
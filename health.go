@@ -0,0 +1,40 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// StreamHealth is the body written by a stream's HealthHandler
+type StreamHealth struct {
+	// Clients is the number of clients currently on the stream
+	Clients int `json:"clients"`
+	// Shutdown is true once the stream has been shut down
+	Shutdown bool `json:"shutdown"`
+	// Uptime is the number of seconds since the stream was created
+	Uptime float64 `json:"uptime"`
+}
+
+// HealthHandler returns a handler reporting the health of the stream as JSON,
+// for use as a readiness check. It responds with 200 OK while the stream is
+// accepting clients, and 503 Service Unavailable once it has been shut down so
+// load balancers stop routing to it.
+func (s *Stream) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.listLock.RLock()
+		health := StreamHealth{
+			Clients:  len(s.clients),
+			Shutdown: s.shutdown,
+			Uptime:   time.Since(s.started).Seconds(),
+		}
+		s.listLock.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if health.Shutdown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	}
+}
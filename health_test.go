@@ -0,0 +1,108 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Calls the stream's health handler and decodes the response
+func checkHealth(t *testing.T, s *Stream) (int, StreamHealth) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.HealthHandler()(rec, httptest.NewRequest("GET", "/health", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want JSON content type, got %q", ct)
+	}
+	var health StreamHealth
+	if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, health
+}
+
+func TestHealthy(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	discardClients(s, 2)
+
+	code, health := checkHealth(t, s)
+	if code != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, code)
+	}
+	if health.Clients != 2 {
+		t.Errorf("want 2 clients, got %d", health.Clients)
+	}
+	if health.Shutdown {
+		t.Error("want a running stream")
+	}
+	if health.Uptime <= 0 {
+		t.Errorf("want a positive uptime, got %v", health.Uptime)
+	}
+}
+
+func TestHealthAfterShutdown(t *testing.T) {
+	s := NewStream()
+	discardClients(s, 2)
+	s.Shutdown()
+
+	code, health := checkHealth(t, s)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("want status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if health.Clients != 0 {
+		t.Errorf("want no clients, got %d", health.Clients)
+	}
+	if !health.Shutdown {
+		t.Error("want a shut down stream")
+	}
+}
+
+func TestHealthDuringShutdown(t *testing.T) {
+	s := NewStream()
+	srv := serve(t, s)
+
+	// a client stuck writing holds up shutting it down
+	w := newBlockingWriter()
+	stuck := NewClientWriter(w)
+	s.Register(stuck)
+	stuck.Send(DataEvent("stuck"))
+	<-w.started
+
+	shutdown := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(shutdown)
+	}()
+
+	// load balancers must be told to stop routing while it drains
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, _ := checkHealth(t, s)
+		if code == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want status %d while shutting down, got %d", http.StatusServiceUnavailable, code)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// and new connections are turned away rather than waiting
+	conn := openStream(t, srv.URL, nil)
+	if conn.resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want status %d, got %d", http.StatusServiceUnavailable, conn.resp.StatusCode)
+	}
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the stuck client finished")
+	default:
+	}
+	w.unblock()
+	<-shutdown
+}
@@ -0,0 +1,96 @@
+package eventsource
+
+import (
+	"time"
+)
+
+// keepAliveComment is sent to idle clients by default. Comments are ignored
+// by browsers but keep proxies from timing out the connection.
+var keepAliveComment = []byte(":\n\n")
+
+// SetKeepAlive sets how long the client may be idle before a keep-alive is
+// sent, to stop proxies and load balancers from closing quiet connections.
+// By default the keep-alive is a comment, which browsers ignore. See
+// SetKeepAliveEvent to send an event instead. Keep-alives are flushed as soon
+// as they are written, through gzip compression if enabled, whatever the
+// client's flush mode.
+// A duration of 0 disables keep-alives, which is the default.
+func (c *Client) SetKeepAlive(d time.Duration) {
+	c.lock.Lock()
+	c.keepAlive = d
+	c.lock.Unlock()
+
+	// wake the worker to start the new interval
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetKeepAliveEvent sets an event to send as the keep-alive instead of a
+// comment, such as an event with a "ping" type that clients can use to check
+// the connection. Browsers only dispatch events that have data, so the event
+// should have some. The event is copied, so it may be reused.
+// Passing nil restores the default comment.
+func (c *Client) SetKeepAliveEvent(e *Event) {
+	var shared *Event
+	if e != nil {
+		shared = e.share()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.keepAliveEvent = shared
+}
+
+// SetKeepAlive sets the keep-alive interval for clients connecting to this
+// stream's HTTP handlers, see Client.SetKeepAlive.
+func (s *Stream) SetKeepAlive(d time.Duration) {
+	s.keepAlive = d
+}
+
+// SetKeepAliveEvent sets the keep-alive event for clients connecting to this
+// stream's HTTP handlers, see Client.SetKeepAliveEvent.
+func (s *Stream) SetKeepAliveEvent(e *Event) {
+	s.keepAliveEvent = nil
+	if e != nil {
+		s.keepAliveEvent = e.share()
+	}
+}
+
+// Restarts the idle timer for the worker. Returns nil when keep-alives are
+// disabled so the worker never wakes for them.
+func (c *Client) idleTimer(t *time.Timer) <-chan time.Time {
+	c.lock.Lock()
+	d := c.keepAlive
+	c.lock.Unlock()
+
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	if d <= 0 {
+		return nil
+	}
+	t.Reset(d)
+	return t.C
+}
+
+// Writes a keep-alive to the idle client. Returns false if the client should
+// stop.
+func (c *Client) writeKeepAlive() bool {
+	c.lock.Lock()
+	ev := c.keepAliveEvent
+	c.lock.Unlock()
+
+	if ev == nil {
+		ev = &Event{}
+		ev.WriteRaw(keepAliveComment)
+	}
+	// a keep-alive is only useful once it reaches the client, so it is
+	// always flushed through any compression straight away
+	return c.writeFrame(ev, false)
+}
@@ -0,0 +1,73 @@
+package eventsource
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for the output to have the given prefix, failing the test if it
+// takes too long
+func waitOutput(t *testing.T, out *syncBuffer, prefix string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.HasPrefix(out.String(), prefix) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want output starting %q, got %q", prefix, out.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeepAliveComment(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	defer c.Shutdown()
+	c.SetKeepAlive(10 * time.Millisecond)
+
+	waitOutput(t, out, ":\n\n:\n\n")
+}
+
+func TestKeepAliveEvent(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	defer c.Shutdown()
+
+	ping := (&Event{}).Type("ping").Data("ping")
+	c.SetKeepAliveEvent(ping)
+	// the event is copied
+	ping.Data("changed")
+	c.SetKeepAlive(10 * time.Millisecond)
+
+	waitOutput(t, out, "event: ping\ndata: ping\n\nevent: ping\ndata: ping\n\n")
+}
+
+func TestKeepAliveEventRemoved(t *testing.T) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	defer c.Shutdown()
+
+	c.SetKeepAliveEvent(DataEvent("ping"))
+	c.SetKeepAliveEvent(nil)
+	c.SetKeepAlive(10 * time.Millisecond)
+
+	waitOutput(t, out, ":\n\n")
+}
+
+func TestStreamKeepAliveEvent(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetKeepAlive(10 * time.Millisecond)
+	s.SetKeepAliveEvent((&Event{}).Type("ping").Data("{}"))
+
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, nil)
+	if conn.resp.StatusCode != http.StatusOK {
+		t.Fatalf("want status %d, got %d", http.StatusOK, conn.resp.StatusCode)
+	}
+	if got, want := conn.next(t), "event: ping\ndata: {}\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
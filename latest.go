@@ -0,0 +1,88 @@
+package eventsource
+
+// SendLatest queues an event under a key, replacing any event queued under
+// the same key that has not been written yet. Only the most recent event for
+// each key is delivered, which suits frequently updated values where a slow
+// client only needs the latest state.
+// Keyed events are delivered in the order their keys were first queued, and
+// independently of events queued with Send, so there is no ordering between
+// the two. SendLatest never blocks.
+// Returns an error if the Client has disconnected
+func (c *Client) SendLatest(key string, ev *Event) error {
+	if ev == nil {
+		return ErrNilEvent
+	}
+	return c.sendLatest(key, ev.share())
+}
+
+// Queues a shared event under a key
+func (c *Client) sendLatest(key string, ev *Event) error {
+	c.sendLock.RLock()
+	defer c.sendLock.RUnlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+
+	c.lock.Lock()
+	if c.latest == nil {
+		c.latest = make(map[string]*Event)
+	}
+	if _, queued := c.latest[key]; !queued {
+		c.latestKeys = append(c.latestKeys, key)
+	}
+	c.latest[key] = ev
+	c.lock.Unlock()
+
+	// wake the worker if it isn't already due to wake
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PublishLatest sends the event to clients that have subscribed to the given
+// topic, replacing any event previously published to the topic that a client
+// has not been sent yet. See Client.SendLatest.
+func (s *Stream) PublishLatest(topic string, e *Event) {
+	defer s.sequence()()
+
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+
+	d := s.deliver(e, false, &s.counters.published)
+	if d == nil {
+		return
+	}
+
+	for cli, topics := range s.clients {
+		if s.subscribed(topics, topic) {
+			d.latest(cli, topic)
+		}
+	}
+}
+
+// Writes all keyed events queued with SendLatest. Returns false if a write
+// failed and the worker should stop.
+func (c *Client) writeLatest() bool {
+	c.lock.Lock()
+	keys, latest := c.latestKeys, c.latest
+	c.latestKeys, c.latest = nil, nil
+	c.lock.Unlock()
+
+	for i, key := range keys {
+		if !c.writeEvent(latest[key]) {
+			for _, rest := range keys[i+1:] {
+				c.unwritten = append(c.unwritten, latest[rest])
+			}
+			return false
+		}
+	}
+	return true
+}
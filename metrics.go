@@ -0,0 +1,74 @@
+package eventsource
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+)
+
+// queueDepthBuckets are the upper bounds of the client queue depth histogram
+var queueDepthBuckets = []int{0, 1, 2, 5, 10, 25, 50, 100}
+
+// MetricsHandler returns a handler exposing the stream's counters in the
+// Prometheus text format, so the stream can be scraped without depending on
+// the Prometheus client libraries. The metrics are:
+//
+//	eventsource_clients                      gauge of current clients
+//	eventsource_clients_connected_total      counter of clients ever added
+//	eventsource_clients_disconnected_total   counter of clients ever removed
+//	eventsource_clients_thrashed_total       counter of clients removed soon after connecting
+//	eventsource_events_broadcast_total       counter of broadcasts
+//	eventsource_events_published_total       counter of publications
+//	eventsource_events_dropped_total         counter of events not sent to a client
+//	eventsource_client_queue_depth           histogram of events queued per client
+//
+// The prometheus module alongside this one has a collector for the same
+// metrics, for use with the Prometheus client libraries.
+func (s *Stream) MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := s.Stats()
+
+		// bucket every client's queue at the time of the scrape
+		buckets := make([]uint64, len(queueDepthBuckets))
+		var count, sum uint64
+		for _, c := range s.registered() {
+			depth := c.QueueLen()
+			for i, bound := range queueDepthBuckets {
+				if depth <= bound {
+					buckets[i]++
+				}
+			}
+			count++
+			sum += uint64(depth)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+
+		writeMetric(out, "eventsource_clients", "gauge", "Number of clients currently on the stream.", stats.CurrentClients)
+		writeMetric(out, "eventsource_clients_connected_total", "counter", "Number of clients ever added to the stream.", stats.ClientsConnected)
+		writeMetric(out, "eventsource_clients_disconnected_total", "counter", "Number of clients ever removed from the stream.", stats.ClientsDisconnected)
+		writeMetric(out, "eventsource_clients_thrashed_total", "counter", "Number of clients removed within the thrash window of connecting.", stats.ClientsThrashed)
+		writeMetric(out, "eventsource_events_broadcast_total", "counter", "Number of events broadcast.", stats.EventsBroadcast)
+		writeMetric(out, "eventsource_events_published_total", "counter", "Number of events published to topics.", stats.EventsPublished)
+		writeMetric(out, "eventsource_events_dropped_total", "counter", "Number of times an event could not be sent to a client.", stats.EventsDropped)
+
+		out.WriteString("# HELP eventsource_client_queue_depth Number of events queued for each client.\n")
+		out.WriteString("# TYPE eventsource_client_queue_depth histogram\n")
+		for i, bound := range queueDepthBuckets {
+			out.WriteString("eventsource_client_queue_depth_bucket{le=\"" + strconv.Itoa(bound) + "\"} " + strconv.FormatUint(buckets[i], 10) + "\n")
+		}
+		out.WriteString("eventsource_client_queue_depth_bucket{le=\"+Inf\"} " + strconv.FormatUint(count, 10) + "\n")
+		out.WriteString("eventsource_client_queue_depth_sum " + strconv.FormatUint(sum, 10) + "\n")
+		out.WriteString("eventsource_client_queue_depth_count " + strconv.FormatUint(count, 10) + "\n")
+
+		out.Flush()
+	}
+}
+
+// Writes a single valued metric in the Prometheus text format
+func writeMetric(out *bufio.Writer, name, kind, help string, value uint64) {
+	out.WriteString("# HELP " + name + " " + help + "\n")
+	out.WriteString("# TYPE " + name + " " + kind + "\n")
+	out.WriteString(name + " " + strconv.FormatUint(value, 10) + "\n")
+}
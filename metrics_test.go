@@ -0,0 +1,55 @@
+package eventsource
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	idle := discardClients(s, 1)[0]
+	s.Broadcast(DataEvent("one"))
+	s.Publish("topic", DataEvent("two"))
+	idle.Flush()
+
+	// a client with an event held on its queue
+	w := newBlockingWriter()
+	defer w.unblock()
+	blocked := NewClientWriter(w)
+	s.Register(blocked)
+	blocked.Send(DataEvent("stuck"))
+	<-w.started
+	blocked.Send(DataEvent("queued"))
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler()(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("want the Prometheus text format, got %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE eventsource_clients gauge",
+		"eventsource_clients 2",
+		"eventsource_clients_connected_total 2",
+		"eventsource_clients_disconnected_total 0",
+		"# TYPE eventsource_events_broadcast_total counter",
+		"eventsource_events_broadcast_total 1",
+		"eventsource_events_published_total 1",
+		"eventsource_events_dropped_total 0",
+		"# TYPE eventsource_clients_thrashed_total counter",
+		"eventsource_clients_thrashed_total 0",
+		"# TYPE eventsource_client_queue_depth histogram",
+		`eventsource_client_queue_depth_bucket{le="0"} 1`,
+		`eventsource_client_queue_depth_bucket{le="1"} 2`,
+		`eventsource_client_queue_depth_bucket{le="+Inf"} 2`,
+		"eventsource_client_queue_depth_sum 1",
+		"eventsource_client_queue_depth_count 2",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("want %q in:\n%s", want, body)
+		}
+	}
+}
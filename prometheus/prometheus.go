@@ -0,0 +1,93 @@
+// Package prometheus exposes the metrics of an eventsource Stream through the
+// Prometheus client library. It is its own module, so that only those who use
+// it depend on the client library.
+package prometheus
+
+import (
+	"github.com/AndrewBurian/eventsource/v2"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// queueDepthBuckets are the upper bounds of the client queue depth histogram,
+// the same as those of Stream.MetricsHandler
+var queueDepthBuckets = []float64{0, 1, 2, 5, 10, 25, 50, 100}
+
+// Collector is a prometheus.Collector for a stream. It reads the stream's
+// counters and the queue of each of its clients at every scrape, so it costs
+// the stream nothing between scrapes.
+// The metrics have the same names as those of Stream.MetricsHandler.
+type Collector struct {
+	stream *eventsource.Stream
+
+	clients      *prom.Desc
+	connected    *prom.Desc
+	disconnected *prom.Desc
+	broadcast    *prom.Desc
+	published    *prom.Desc
+	dropped      *prom.Desc
+	thrashed     *prom.Desc
+	queueDepth   *prom.Desc
+}
+
+// NewCollector returns a collector for the stream, to be registered with a
+// prometheus.Registerer. Any constant labels are added to every metric, to
+// tell several streams apart.
+func NewCollector(s *eventsource.Stream, constLabels prom.Labels) *Collector {
+	desc := func(name, help string) *prom.Desc {
+		return prom.NewDesc(name, help, nil, constLabels)
+	}
+
+	return &Collector{
+		stream:       s,
+		clients:      desc("eventsource_clients", "Number of clients currently on the stream."),
+		connected:    desc("eventsource_clients_connected_total", "Number of clients ever added to the stream."),
+		disconnected: desc("eventsource_clients_disconnected_total", "Number of clients ever removed from the stream."),
+		broadcast:    desc("eventsource_events_broadcast_total", "Number of events broadcast."),
+		published:    desc("eventsource_events_published_total", "Number of events published to topics."),
+		dropped:      desc("eventsource_events_dropped_total", "Number of times an event could not be sent to a client."),
+		thrashed:     desc("eventsource_clients_thrashed_total", "Number of clients removed within the thrash window of connecting."),
+		queueDepth:   desc("eventsource_client_queue_depth", "Number of events queued for each client."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.clients
+	ch <- c.connected
+	ch <- c.disconnected
+	ch <- c.broadcast
+	ch <- c.published
+	ch <- c.dropped
+	ch <- c.thrashed
+	ch <- c.queueDepth
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	stats := c.stream.Stats()
+
+	ch <- prom.MustNewConstMetric(c.clients, prom.GaugeValue, float64(stats.CurrentClients))
+	ch <- prom.MustNewConstMetric(c.connected, prom.CounterValue, float64(stats.ClientsConnected))
+	ch <- prom.MustNewConstMetric(c.disconnected, prom.CounterValue, float64(stats.ClientsDisconnected))
+	ch <- prom.MustNewConstMetric(c.broadcast, prom.CounterValue, float64(stats.EventsBroadcast))
+	ch <- prom.MustNewConstMetric(c.published, prom.CounterValue, float64(stats.EventsPublished))
+	ch <- prom.MustNewConstMetric(c.dropped, prom.CounterValue, float64(stats.EventsDropped))
+	ch <- prom.MustNewConstMetric(c.thrashed, prom.CounterValue, float64(stats.ClientsThrashed))
+
+	// bucket every client's queue at the time of the scrape, the buckets
+	// counting cumulatively as Prometheus expects
+	buckets := make(map[float64]uint64, len(queueDepthBuckets))
+	var count uint64
+	var sum float64
+	for _, client := range c.stream.Clients() {
+		depth := float64(client.QueueLen())
+		for _, bound := range queueDepthBuckets {
+			if depth <= bound {
+				buckets[bound]++
+			}
+		}
+		count++
+		sum += depth
+	}
+	ch <- prom.MustNewConstHistogram(c.queueDepth, count, sum, buckets)
+}
@@ -0,0 +1,116 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewBurian/eventsource/v2"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// A writer that blocks every write until released, so events stay queued
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return len(p), nil
+}
+
+// Scrapes the registry over HTTP as Prometheus would
+func scrape(t *testing.T, reg *prom.Registry) string {
+	t.Helper()
+
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCollectorScrape(t *testing.T) {
+	s := eventsource.NewStream()
+	defer s.Shutdown()
+
+	idle := eventsource.NewClientWriter(ioutil.Discard)
+	s.Register(idle)
+	s.Broadcast(eventsource.DataEvent("one"))
+	s.Publish("topic", eventsource.DataEvent("two"))
+	idle.Flush()
+
+	// one idle client, and one with an event held on its queue
+	w := &blockingWriter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(w.release)
+	blocked := eventsource.NewClientWriter(w)
+	s.Register(blocked)
+	blocked.Send(eventsource.DataEvent("stuck"))
+	select {
+	case <-w.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the write")
+	}
+	blocked.Send(eventsource.DataEvent("queued"))
+
+	reg := prom.NewRegistry()
+	reg.MustRegister(NewCollector(s, prom.Labels{"stream": "test"}))
+	body := scrape(t, reg)
+
+	for _, want := range []string{
+		"# TYPE eventsource_clients gauge",
+		`eventsource_clients{stream="test"} 2`,
+		`eventsource_clients_connected_total{stream="test"} 2`,
+		`eventsource_clients_disconnected_total{stream="test"} 0`,
+		"# TYPE eventsource_events_broadcast_total counter",
+		`eventsource_events_broadcast_total{stream="test"} 1`,
+		`eventsource_events_published_total{stream="test"} 1`,
+		"# TYPE eventsource_events_dropped_total counter",
+		`eventsource_clients_thrashed_total{stream="test"} 0`,
+		"# TYPE eventsource_client_queue_depth histogram",
+		`eventsource_client_queue_depth_bucket{stream="test",le="0"} 1`,
+		`eventsource_client_queue_depth_bucket{stream="test",le="1"} 2`,
+		`eventsource_client_queue_depth_bucket{stream="test",le="+Inf"} 2`,
+		`eventsource_client_queue_depth_sum{stream="test"} 1`,
+		`eventsource_client_queue_depth_count{stream="test"} 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("want %q in scrape:\n%s", want, body)
+		}
+	}
+}
+
+func TestCollectorLint(t *testing.T) {
+	s := eventsource.NewStream()
+	defer s.Shutdown()
+
+	problems, err := testutil.CollectAndLint(NewCollector(s, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("%s: %s", p.Metric, p.Text)
+	}
+}
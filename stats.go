@@ -0,0 +1,105 @@
+package eventsource
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// StreamStats is a point in time snapshot of a stream's counters
+type StreamStats struct {
+	// EventsBroadcast is the number of calls to Broadcast
+	EventsBroadcast uint64
+	// EventsPublished is the number of calls to Publish
+	EventsPublished uint64
+	// EventsDropped is the number of times an event could not be sent to a client
+	EventsDropped uint64
+	// ClientsConnected is the number of clients ever added to the stream
+	ClientsConnected uint64
+	// ClientsDisconnected is the number of clients ever removed from the stream
+	ClientsDisconnected uint64
+	// CurrentClients is the number of clients currently on the stream
+	CurrentClients uint64
+	// ClientsThrashed is the number of clients removed within the thrash
+	// window of connecting, see Stream.SetThrashWindow
+	ClientsThrashed uint64
+}
+
+// Counters backing StreamStats. Must only be accessed atomically.
+type streamCounters struct {
+	broadcast    uint64
+	published    uint64
+	dropped      uint64
+	connected    uint64
+	disconnected uint64
+	lastID       uint64
+	thrashed     uint64
+}
+
+// Stats returns a snapshot of the stream's counters.
+// It is safe to call at any time from any goroutine.
+func (s *Stream) Stats() StreamStats {
+	stats := StreamStats{
+		EventsBroadcast:     atomic.LoadUint64(&s.counters.broadcast),
+		EventsPublished:     atomic.LoadUint64(&s.counters.published),
+		EventsDropped:       atomic.LoadUint64(&s.counters.dropped),
+		ClientsDisconnected: atomic.LoadUint64(&s.counters.disconnected),
+		ClientsConnected:    atomic.LoadUint64(&s.counters.connected),
+		ClientsThrashed:     atomic.LoadUint64(&s.counters.thrashed),
+	}
+	stats.CurrentClients = stats.ClientsConnected - stats.ClientsDisconnected
+	return stats
+}
+
+// Counters backing Client.Stats. Must only be accessed atomically.
+type clientCounters struct {
+	events uint64
+	bytes  uint64
+}
+
+// Stats returns the number of events and bytes written to the client so far.
+// Bytes are counted as written to the connection, after any compression, and
+// include keep-alives, which are not counted as events. Each event sent with
+// SendBatch, or replayed from an EventStore, counts separately.
+// It is safe to call at any time from any goroutine.
+func (c *Client) Stats() (events uint64, bytes uint64) {
+	return atomic.LoadUint64(&c.counters.events), atomic.LoadUint64(&c.counters.bytes)
+}
+
+// Counts the bytes written through to the underlying writer
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (cw countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.n, uint64(n))
+	return n, err
+}
+
+// SetThrashWindow sets how soon after connecting a client must be removed from
+// the stream to be counted in ClientsThrashed. Many clients disconnecting this
+// quickly usually means clients are misconfigured and reconnecting in a loop.
+// Clients removed by shutting the stream down are not counted.
+// A window of 0 disables the count, which is the default.
+func (s *Stream) SetThrashWindow(d time.Duration) {
+	s.thrashWindow = d
+}
+
+// Counts a client removed from the stream if it was only connected briefly
+func (s *Stream) countThrash(c *Client) {
+	if s.thrashWindow > 0 && c.Age() < s.thrashWindow {
+		atomic.AddUint64(&s.counters.thrashed, 1)
+	}
+}
+
+// ConnectedAt returns the time the client was created
+func (c *Client) ConnectedAt() time.Time {
+	return c.created
+}
+
+// Age returns how long ago the client was created
+func (c *Client) Age() time.Duration {
+	return time.Since(c.created)
+}
@@ -0,0 +1,104 @@
+package eventsource
+
+import (
+	"sync"
+)
+
+// EventStore keeps a history of the events broadcast on a stream, so that
+// clients reconnecting with a Last-Event-ID header can be sent the events they
+// missed.
+// Implementations must be safe for concurrent use, and may persist events to
+// survive restarts.
+type EventStore interface {
+	// Append adds an event to the history. The event is shared and must not be
+	// modified.
+	Append(*Event)
+
+	// Since returns the events following the one with the given id, oldest
+	// first.
+	Since(lastID string) []*Event
+}
+
+// MemoryStore is an EventStore keeping a fixed number of the most recent events
+// in memory.
+type MemoryStore struct {
+	events []*Event
+	next   int
+	full   bool
+	lock   sync.Mutex
+}
+
+// NewMemoryStore creates a store keeping the last size events
+func NewMemoryStore(size int) *MemoryStore {
+	if size < 1 {
+		size = 1
+	}
+	return &MemoryStore{
+		events: make([]*Event, size),
+	}
+}
+
+// Append adds an event to the store, discarding the oldest event if it is full
+func (m *MemoryStore) Append(e *Event) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.events[m.next] = e
+	m.next++
+	if m.next == len(m.events) {
+		m.next = 0
+		m.full = true
+	}
+}
+
+// Since returns the stored events following the last one with the given id,
+// oldest first.
+// If no stored event has the id, it may have already been discarded, so all
+// stored events are returned.
+func (m *MemoryStore) Since(lastID string) []*Event {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// oldest first
+	var history []*Event
+	if m.full {
+		history = append(history, m.events[m.next:]...)
+	}
+	history = append(history, m.events[:m.next]...)
+
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].id == lastID {
+			return history[i+1:]
+		}
+	}
+	return history
+}
+
+// SetEventStore sets a store that events sent with Broadcast are appended to.
+// Clients connecting to this stream's HTTP handlers with a Last-Event-ID header
+// are sent the events the store has since that id before any other event.
+// Passing nil removes the store.
+func (s *Stream) SetEventStore(store EventStore) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	s.store = store
+}
+
+// replay sends the client the stored events since lastID.
+// Must be called with the stream's lock held, so no broadcast can be missed or
+// sent twice.
+func (s *Stream) replay(c *Client, lastID string) {
+	if s.store == nil || lastID == "" {
+		return
+	}
+
+	history := s.store.Since(lastID)
+	if len(history) == 0 {
+		return
+	}
+
+	if err := c.SendBatch(history); err != nil {
+		tryPushError(s.errors, c, err)
+	}
+}
@@ -33,8 +33,40 @@ A quick example of a simple sever that broadcasts a "tick" event every second
 package eventsource
 
 import (
+	"context"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNotAcceptable is returned by Upgrade when the request does not
+	// accept an event stream
+	ErrNotAcceptable = errors.New("eventsource: request does not accept an event stream")
+
+	// ErrTooManyClients is returned by Upgrade when the stream already has as
+	// many clients as it allows
+	ErrTooManyClients = errors.New("eventsource: too many clients")
+
+	// ErrPreflightRequest is returned by Upgrade when the request was a CORS
+	// preflight request, which has been answered
+	ErrPreflightRequest = errors.New("eventsource: preflight request answered")
+
+	// ErrEventTooLarge is pushed to a stream's Errors channel when an event is
+	// not sent for being larger than the stream allows
+	ErrEventTooLarge = errors.New("eventsource: event too large")
+
+	// ErrStreamShutdown is returned by Upgrade when the stream has been shut
+	// down and accepts no more clients
+	ErrStreamShutdown = errors.New("eventsource: stream has been shut down")
 )
 
 // Stream abstracts several client connections together and allows
@@ -42,16 +74,56 @@ import (
 // A stream also implements an http.Handler to easily register incoming
 // http requests as new clients.
 type Stream struct {
-	clients           map[*Client]topicList
-	listLock          sync.RWMutex
-	shutdownWait      sync.WaitGroup
-	clientConnectHook func(*http.Request, *Client)
-	errors            chan *ClientError
+	counters             streamCounters
+	degraded             int32
+	clients              map[*Client]topicList
+	snapshot             atomic.Value
+	listLock             sync.RWMutex
+	shutdownWait         sync.WaitGroup
+	clientConnectHooks   []func(*http.Request, *Client)
+	clientDisconnectHook func(*http.Request, *Client)
+	authorizer           func(*http.Request) error
+	errors               chan *ClientError
+	initialEvent         *Event
+	retryEvent           *Event
+	healthyRetry         *Event
+	degradedRetry        *Event
+	degradedClients      int
+	maxEventBytes        int
+	ordered              bool
+	movedTo              map[*Client]*Stream
+	idKey                string
+	byID                 map[string]map[*Client]bool
+	idOf                 map[*Client]string
+	debug                bool
+	thrashWindow         time.Duration
+	wrap                 func(io.Writer) io.Writer
+	proxyFriendly        bool
+	compact              bool
+	order                sync.Mutex
+	headers              http.Header
+	corsOrigins          map[string]bool
+	corsCredentials      bool
+	skipAcceptCheck      bool
+	wildcards            bool
+	factory              EventFactory
+	store                EventStore
+	keepAlive            time.Duration
+	keepAliveEvent       *Event
+	joined               chan struct{}
+	autoID               bool
+	lastIDParam          string
+	started              time.Time
+	shutdown             bool
+	gzip                 bool
+	maxClients           int
+	reserved             int
 }
 
 // ClientError is published down a stream's Error channel when there are
 // errors with Publishing or Broadcasting.
-// The error is the value returned from the Client.Send call
+// The error is the value returned from the Client.Send call, or
+// ErrEventTooLarge with a nil Client for events that were not sent at all.
 type ClientError struct {
 	Err    error
 	Client *Client
@@ -63,6 +135,7 @@ type topicList map[string]bool
 func NewStream() *Stream {
 	return &Stream{
 		clients: make(map[*Client]topicList),
+		started: time.Now(),
 	}
 }
 
@@ -79,58 +152,342 @@ func (s *Stream) Errors(size uint) <-chan *ClientError {
 
 // Register adds a client to the stream to receive all broadcast
 // messages. Has no effect if the client is already registered.
+// If the stream has been shut down, the client is shut down instead.
 func (s *Stream) Register(c *Client) {
+	if !s.register(c, false, "") {
+		c.Shutdown()
+	}
+}
+
+// Registers a client, consuming a slot reserved by the HTTP handler if set.
+// Returns false if the stream has been shut down and the client was not
+// registered.
+func (s *Stream) register(c *Client, reserved bool, lastID string) bool {
 	s.listLock.Lock()
 	defer s.listLock.Unlock()
 
+	if reserved {
+		s.reserved--
+	}
+
+	if s.shutdown {
+		return false
+	}
+
 	// see if the client has been registered
 	if _, found := s.clients[c]; found {
-		return
+		return true
 	}
+	delete(s.movedTo, c)
 
 	// append new client
 	s.clients[c] = make(topicList)
+	atomic.AddUint64(&s.counters.connected, 1)
+	s.indexID(c)
+	s.updateSnapshot()
+	s.signalJoined()
+
+	// catch the client up before any broadcast can reach it
+	s.replay(c, lastID)
+	return true
+}
+
+// Rebuilds the snapshot of registered clients read by broadcasts.
+// Must be called with the stream's lock held for writing.
+func (s *Stream) updateSnapshot() {
+	clients := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.snapshot.Store(clients)
+}
+
+// Returns the latest snapshot of registered clients. The slice is shared and
+// must not be modified.
+func (s *Stream) registered() []*Client {
+	clients, _ := s.snapshot.Load().([]*Client)
+	return clients
 }
 
 // Remove will remove a client from this stream, but not shut the client down.
+// Clients moved to another stream with TransferTo are removed from there.
 func (s *Stream) Remove(c *Client) {
+	s.listLock.Lock()
+	if _, found := s.clients[c]; found {
+		delete(s.clients, c)
+		atomic.AddUint64(&s.counters.disconnected, 1)
+		s.unindexID(c)
+		s.updateSnapshot()
+		s.countThrash(c)
+		s.listLock.Unlock()
+		return
+	}
+	moved, found := s.movedTo[c]
+	delete(s.movedTo, c)
+	s.listLock.Unlock()
+
+	// handlers remove their client from the stream they connected to, so
+	// follow it to wherever it was moved
+	if found {
+		moved.Remove(c)
+	}
+}
+
+// transferLock is held to lock two streams at once, so transfers in opposite
+// directions can never deadlock
+var transferLock sync.Mutex
+
+// TransferTo moves every client registered on this stream, with its topic
+// subscriptions, to the other stream without disconnecting it. No event sent
+// through either stream can be missed or received twice by a moved client.
+// Clients connected through this stream's HTTP handlers are still removed from
+// the other stream when they disconnect.
+// Returns ErrStreamShutdown without moving any clients if the other stream has
+// been shut down.
+func (s *Stream) TransferTo(other *Stream) error {
+	if other == s {
+		return nil
+	}
+
+	transferLock.Lock()
+	defer transferLock.Unlock()
+
 	s.listLock.Lock()
 	defer s.listLock.Unlock()
+	other.listLock.Lock()
+	defer other.listLock.Unlock()
+
+	if other.shutdown {
+		return ErrStreamShutdown
+	}
 
-	delete(s.clients, c)
+	if s.movedTo == nil && len(s.clients) > 0 {
+		s.movedTo = make(map[*Client]*Stream)
+	}
+	for c, topics := range s.clients {
+		if existing, found := other.clients[c]; found {
+			for topic, subscribed := range topics {
+				if subscribed {
+					existing[topic] = true
+				}
+			}
+		} else {
+			other.clients[c] = topics
+			atomic.AddUint64(&other.counters.connected, 1)
+			other.indexID(c)
+		}
+
+		delete(s.clients, c)
+		atomic.AddUint64(&s.counters.disconnected, 1)
+		s.unindexID(c)
+		s.movedTo[c] = other
+	}
+
+	s.updateSnapshot()
+	other.updateSnapshot()
+	other.signalJoined()
+	return nil
 }
 
 // Broadcast sends the event to all clients registered on this stream.
+// The event is also appended to the stream's event store, if one is set.
+// A nil event is ignored.
 func (s *Stream) Broadcast(e *Event) {
+	s.BroadcastCount(e)
+}
+
+// BroadcastCount sends the event to all clients registered on this stream in
+// the same way as Broadcast, and returns the number of clients it was queued
+// for. Clients that are closing or stalled are not counted.
+func (s *Stream) BroadcastCount(e *Event) int {
+	return s.broadcast(e, false)
+}
+
+// BroadcastOwned sends the event to all clients registered on this stream in
+// the same way as Broadcast, but without copying it first. The stream takes
+// ownership of the event, which must never be used again by the caller.
+func (s *Stream) BroadcastOwned(e *Event) {
+	s.broadcast(e, true)
+}
+
+// Broadcasts an event, copying it first unless the stream owns it
+func (s *Stream) broadcast(e *Event, owned bool) int {
+	defer s.sequence()()
+
+	// broadcasts read a snapshot of the clients so registering never blocks
+	// them, but replaying stored events relies on the two excluding each other
 	s.listLock.RLock()
-	defer s.listLock.RUnlock()
+	store := s.store
+	if store == nil {
+		s.listLock.RUnlock()
+	} else {
+		defer s.listLock.RUnlock()
+	}
 
-	for cli := range s.clients {
-		err := cli.Send(e)
+	d := s.deliver(e, owned, &s.counters.broadcast)
+	if d == nil {
+		return 0
+	}
 
-		if err != nil {
-			tryPushError(s.errors, cli, err)
+	if store != nil {
+		store.Append(d.event)
+	}
+
+	for _, cli := range s.registered() {
+		d.to(cli)
+	}
+	return d.sent
+}
+
+// Emit sends the event to the clients registered for broadcasts and to the
+// clients subscribed to any of the given topics, with each client receiving it
+// exactly once.
+// Every client on a stream receives broadcasts, including those registered by
+// subscribing to a topic, so the event reaches every client in the same way as
+// Broadcast. It is counted as both a broadcast and, if any topics are given, a
+// publication.
+// Returns the number of clients the event was queued for.
+func (s *Stream) Emit(e *Event, topics ...string) int {
+	if e == nil {
+		return 0
+	}
+	if len(topics) > 0 {
+		atomic.AddUint64(&s.counters.published, 1)
+	}
+	return s.broadcast(e, false)
+}
+
+// BroadcastChannel starts a goroutine that broadcasts every event received
+// from ch, in order, until ch is closed or the context is done. No event is
+// broadcast once the context is done.
+func (s *Stream) BroadcastChannel(ctx context.Context, ch <-chan *Event) {
+	go func() {
+		for {
+			select {
+			case e, ok := <-ch:
+				// both may be ready at once
+				if !ok || ctx.Err() != nil {
+					return
+				}
+				s.Broadcast(e)
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+}
+
+// BroadcastFunc sends the event to all clients registered on this stream for
+// which filter returns true.
+// The filter is called for every registered client, so it should be cheap.
+func (s *Stream) BroadcastFunc(e *Event, filter func(*Client) bool) {
+	defer s.sequence()()
+
+	d := s.deliver(e, false, &s.counters.broadcast)
+	if d == nil {
+		return
+	}
+
+	for _, cli := range s.registered() {
+		if filter(cli) {
+			d.to(cli)
+		}
+	}
+}
+
+// BroadcastRaw sends bytes already encoded in wire format to all clients
+// registered on this stream, exactly as given. The bytes are not validated,
+// and should contain complete events. They are copied, so p may be reused.
+func (s *Stream) BroadcastRaw(p []byte) {
+	defer s.sequence()()
+
+	// raw events are prepared by definition and safe to share
+	raw := &Event{}
+	raw.WriteRaw(p)
+
+	d := s.deliver(raw, true, &s.counters.broadcast)
+	if d == nil {
+		return
+	}
+
+	for _, cli := range s.registered() {
+		d.to(cli)
 	}
 }
 
+// BroadcastString sends a data event with the given string to all clients
+// registered on this stream.
+// The event is created with the stream's factory if one is set.
+func (s *Stream) BroadcastString(data string) {
+	e := s.newEvent()
+	e.WriteString(data)
+	s.Broadcast(e)
+}
+
+// BroadcastWith creates an event with the factory, passes it to fill to be
+// completed, and then sends it to all clients registered on this stream.
+// If f is nil the stream's factory is used, if any.
+func (s *Stream) BroadcastWith(f EventFactory, fill func(*Event)) {
+	var e *Event
+	if f != nil {
+		e = f.New()
+	} else {
+		e = s.newEvent()
+	}
+
+	if fill != nil {
+		fill(e)
+	}
+	s.Broadcast(e)
+}
+
+// BroadcastMarshal renders m as an event and sends it to all clients
+// registered on this stream.
+// If rendering fails the error is returned and nothing is sent.
+func (s *Stream) BroadcastMarshal(m EventMarshaler) error {
+	e, err := m.MarshalEvent()
+	if err != nil {
+		return err
+	}
+	s.Broadcast(e)
+	return nil
+}
+
 // Subscribe add the client to the list of clients receiving publications
 // to this topic. Subscribe will also Register an unregistered
-// client.
-func (s *Stream) Subscribe(topic string, c *Client) {
+// client. If the stream has been shut down, the client is shut down instead.
+// Returns a handle that can be used to unsubscribe again.
+func (s *Stream) Subscribe(topic string, c *Client) *Subscription {
 	s.listLock.Lock()
 	defer s.listLock.Unlock()
 
+	sub := &Subscription{
+		stream: s,
+		topic:  topic,
+		client: c,
+	}
+
 	// see if the client is registered
 	topics, found := s.clients[c]
 
+	if !found && s.shutdown {
+		// never block on the client with the lock held
+		go c.Shutdown()
+		return sub
+	}
+
 	// register if not
 	if !found {
 		topics = make(topicList)
 		s.clients[c] = topics
+		atomic.AddUint64(&s.counters.connected, 1)
+		s.indexID(c)
+		s.updateSnapshot()
+		s.signalJoined()
 	}
 
 	topics[topic] = true
+	return sub
 }
 
 // Unsubscribe removes clients from the topic, but not from broadcasts.
@@ -145,31 +502,137 @@ func (s *Stream) Unsubscribe(topic string, c *Client) {
 	topics[topic] = false
 }
 
+// PublishMulti sends the event to clients that have subscribed to any of the
+// given topics. Each client receives the event at most once, no matter how
+// many of the topics it is subscribed to.
+func (s *Stream) PublishMulti(topics []string, e *Event) {
+	defer s.sequence()()
+
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+
+	d := s.deliver(e, false, &s.counters.published)
+	if d == nil {
+		return
+	}
+
+	for cli, subscriptions := range s.clients {
+		for _, topic := range topics {
+			if s.subscribed(subscriptions, topic) {
+				d.to(cli)
+				break
+			}
+		}
+	}
+}
+
+// UnsubscribeAll removes the client from every topic, but not from broadcasts.
+func (s *Stream) UnsubscribeAll(c *Client) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	if _, found := s.clients[c]; !found {
+		return
+	}
+	s.clients[c] = make(topicList)
+}
+
 // Publish sends the event to clients that have subscribed to the given topic.
+// A nil event is ignored.
 func (s *Stream) Publish(topic string, e *Event) {
+	defer s.sequence()()
+
 	s.listLock.RLock()
 	defer s.listLock.RUnlock()
 
-	for cli, topics := range s.clients {
-		if topics[topic] {
+	d := s.deliver(e, false, &s.counters.published)
+	if d == nil {
+		return
+	}
 
-			err := cli.Send(e)
-			if err != nil {
-				tryPushError(s.errors, cli, err)
-			}
+	for cli, topics := range s.clients {
+		if s.subscribed(topics, topic) {
+			d.to(cli)
 		}
 	}
 }
 
+// PublishString sends a data event with the given string to clients that
+// have subscribed to the given topic.
+// The event is created with the stream's factory if one is set.
+func (s *Stream) PublishString(topic, data string) {
+	e := s.newEvent()
+	e.WriteString(data)
+	s.Publish(topic, e)
+}
+
+// PublishMarshal renders m as an event and sends it to clients that have
+// subscribed to the given topic.
+// If rendering fails the error is returned and nothing is sent.
+func (s *Stream) PublishMarshal(topic string, m EventMarshaler) error {
+	e, err := m.MarshalEvent()
+	if err != nil {
+		return err
+	}
+	s.Publish(topic, e)
+	return nil
+}
+
 // Shutdown terminates all clients connected to the stream and removes them
 func (s *Stream) Shutdown() {
+	// the lock is not held while the clients drain, so a stuck client never
+	// holds up health checks or connections being turned away
+	for _, client := range s.takeClients() {
+		client.Shutdown()
+	}
+}
+
+// ShutdownContext terminates all clients connected to the stream and removes
+// them, shutting the clients down in parallel.
+// If the context expires before every client has finished, the context's error
+// is returned and the remaining clients are abandoned to finish on their own.
+func (s *Stream) ShutdownContext(ctx context.Context) error {
+	clients := s.takeClients()
+
+	done := make(chan struct{})
+	var wait sync.WaitGroup
+	wait.Add(len(clients))
+	for _, client := range clients {
+		go func(c *Client) {
+			c.Shutdown()
+			wait.Done()
+		}(client)
+	}
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Marks the stream shut down and removes every client from it, returning the
+// clients so they may be shut down without holding the lock
+func (s *Stream) takeClients() []*Client {
 	s.listLock.Lock()
 	defer s.listLock.Unlock()
 
+	s.shutdown = true
+	clients := make([]*Client, 0, len(s.clients))
 	for client := range s.clients {
-		client.Shutdown()
+		clients = append(clients, client)
 		delete(s.clients, client)
+		atomic.AddUint64(&s.counters.disconnected, 1)
 	}
+	s.byID = nil
+	s.idOf = nil
+	s.updateSnapshot()
+	return clients
 }
 
 // CloseTopic removes all client associations with this topic, but does not
@@ -183,83 +646,695 @@ func (s *Stream) CloseTopic(topic string) {
 	}
 }
 
+// CloseTopicWith sends a final event to the clients subscribed to this topic,
+// then removes all client associations with it in the same way as CloseTopic.
+// No publication to the topic can reach the clients after the final event.
+func (s *Stream) CloseTopicWith(topic string, final *Event) {
+	defer s.sequence()()
+
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	d := s.deliver(final, false, &s.counters.published)
+
+	for cli, topics := range s.clients {
+		if !topics[topic] {
+			continue
+		}
+
+		if d != nil {
+			d.to(cli)
+		}
+		topics[topic] = false
+	}
+}
+
 // ServeHTTP takes a client connection, registers it for broadcasts,
 // then blocks so long as the connection is alive.
 func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serveClient(w, r, nil)
+}
 
-	// ensure the client accepts an event-stream
-	if !checkRequest(r) {
-		http.Error(w, "This is an EventStream endpoint", http.StatusNotAcceptable)
-		return
+// TopicHandler returns an HTTP handler that will register a client for broadcasts
+// and for any topics, and then block so long as they are connected
+func (s *Stream) TopicHandler(topics []string) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.serveClient(w, r, topics)
 	}
+}
 
-	// create the client
-	c := NewClient(w, r)
-	if c == nil {
-		http.Error(w, "EventStream not supported for this connection", http.StatusInternalServerError)
-		return
+// QueryTopicHandler returns an HTTP handler that will register a client for
+// broadcasts and for the topics named by the given query parameter, and then
+// block so long as they are connected.
+// Multiple topics may be requested by repeating the parameter, for example
+// "?topic=news&topic=sports". A request naming no topics receives only broadcasts.
+// If allowed is not empty, requests for topics not in it are rejected.
+func (s *Stream) QueryTopicHandler(param string, allowed []string) http.HandlerFunc {
+
+	allowList := make(topicList)
+	for _, topic := range allowed {
+		allowList[topic] = true
 	}
 
-	// wait for the client to exit or be shutdown
-	s.Register(c)
-	if s.clientConnectHook != nil {
-		s.clientConnectHook(r, c)
+	return func(w http.ResponseWriter, r *http.Request) {
+		topics := r.URL.Query()[param]
+
+		// check the requested topics are permitted
+		if len(allowList) > 0 {
+			for _, topic := range topics {
+				if !allowList[topic] {
+					http.Error(w, "Unknown topic "+topic, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		s.serveClient(w, r, topics)
 	}
-	c.Wait()
-	s.Remove(c)
 }
 
-// TopicHandler returns an HTTP handler that will register a client for broadcasts
-// and for any topics, and then block so long as they are connected
-func (s *Stream) TopicHandler(topics []string) http.HandlerFunc {
+// PathTopicHandler returns an HTTP handler that will register a client for
+// broadcasts and for the topic named by the rest of the request path after the
+// prefix, and then block so long as they are connected.
+// For example with a prefix of "/events/", a request to "/events/orders"
+// subscribes to "orders". Leading and trailing slashes are ignored, and the
+// topic is unescaped, so "/events/a%2Fb/" subscribes to "a/b". A request with
+// nothing after the prefix receives only broadcasts. Requests outside the
+// prefix, including those where it is only part of a path segment such as
+// "/eventsorders" for a prefix of "/events", are rejected with 404 Not Found.
+func (s *Stream) PathTopicHandler(prefix string) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		// ensure the client accepts an event-stream
-		if !checkRequest(r) {
-			http.Error(w, "This is an EventStream endpoint", http.StatusNotAcceptable)
+		// the prefix must end at a path segment boundary, so "/events" does
+		// not serve "/eventsorders"
+		path := r.URL.EscapedPath()
+		rest := strings.TrimPrefix(path, prefix)
+		if !strings.HasPrefix(path, prefix) ||
+			rest != "" && !strings.HasSuffix(prefix, "/") && rest[0] != '/' {
+			http.NotFound(w, r)
 			return
 		}
 
-		// create the client
-		c := NewClient(w, r)
-		if c == nil {
-			http.Error(w, "EventStream not supported for this connection", http.StatusInternalServerError)
+		topic, err := url.PathUnescape(strings.Trim(rest, "/"))
+		if err != nil {
+			http.Error(w, "Invalid topic", http.StatusBadRequest)
 			return
 		}
 
-		// broadcasts
-		s.Register(c)
+		var topics []string
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+		s.serveClient(w, r, topics)
+	}
+}
 
-		// topics
-		for _, topic := range topics {
-			s.Subscribe(topic, c)
+// Upgrade converts the request into an event stream client registered on
+// this stream, and returns it without blocking. The same checks, headers,
+// initial events and connect hooks as the stream's HTTP handler are applied.
+// If the request can not be upgraded an error response has already been sent
+// and the error is returned.
+//
+// The caller is responsible for keeping the handler alive by calling Wait on
+// the client, and for calling Remove once it returns. Disconnect hooks are only
+// called by the stream's own handlers.
+func (s *Stream) Upgrade(w http.ResponseWriter, r *http.Request) (*Client, error) {
+	return s.upgrade(w, r, nil)
+}
+
+// Registers a client for broadcasts and any topics, and then blocks so long as
+// they are connected
+func (s *Stream) serveClient(w http.ResponseWriter, r *http.Request, topics []string) {
+	c, err := s.upgrade(w, r, topics)
+	if err != nil {
+		return
+	}
+
+	// wait for the client to exit or be shutdown
+	c.Wait()
+	s.Remove(c)
+
+	if s.clientDisconnectHook != nil {
+		s.clientDisconnectHook(r, c)
+	}
+}
+
+// Creates a client for the request and registers it for broadcasts and any
+// topics. Sends an error response if that is not possible.
+func (s *Stream) upgrade(w http.ResponseWriter, r *http.Request, topics []string) (*Client, error) {
+
+	// cross origin requests
+	if s.handleCORS(w, r) {
+		return nil, ErrPreflightRequest
+	}
+
+	// ensure the client accepts an event-stream
+	if !s.skipAcceptCheck && !checkRequest(r) {
+		http.Error(w, "This is an EventStream endpoint", http.StatusNotAcceptable)
+		return nil, ErrNotAcceptable
+	}
+
+	// reject the client before anything is started for it
+	if s.authorizer != nil {
+		if err := s.authorizer(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return nil, err
 		}
+	}
+
+	// hold a slot for the client until it is registered
+	if err := s.reserve(); err != nil {
+		if err == ErrStreamShutdown {
+			http.Error(w, "EventStream has shut down", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "Too many EventStream clients", http.StatusServiceUnavailable)
+		}
+		return nil, err
+	}
 
-		if s.clientConnectHook != nil {
-			s.clientConnectHook(r, c)
+	// custom headers must be set before the client flushes them
+	for key, values := range s.headers {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	if s.proxyFriendly {
+		if w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", "no-cache, no-transform")
+		}
+		if w.Header().Get("X-Accel-Buffering") == "" {
+			w.Header().Set("X-Accel-Buffering", "no")
 		}
+	}
+
+	// create the client
+	c, err := newClient(context.Background(), w, r, s.gzip && acceptsGzip(r), s.wrap)
+	if err != nil {
+		s.release()
+		http.Error(w, "EventStream not supported for this connection: "+err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	if s.keepAlive > 0 {
+		c.SetKeepAlive(s.keepAlive)
+		c.SetKeepAliveEvent(s.keepAliveEvent)
+	}
 
-		// wait for the client to exit or be shutdown
-		c.Wait()
-		s.Remove(c)
+	// greet the client before anything else is sent, while no broadcast can
+	// reach it yet
+	if retry := s.retryFor(); retry != nil {
+		c.send(retry)
 	}
+	if s.initialEvent != nil {
+		c.send(s.initialEvent)
+	}
+
+	// broadcasts, after any events the client missed
+	if !s.register(c, true, s.lastEventID(r)) {
+		// the response has started, so the client can only be closed
+		c.Shutdown()
+		return nil, ErrStreamShutdown
+	}
+
+	// topics
+	for _, topic := range topics {
+		s.Subscribe(topic, c)
+	}
+
+	for _, hook := range s.clientConnectHooks {
+		hook(r, c)
+	}
+
+	// hooks may have given the client its id
+	s.listLock.Lock()
+	if _, found := s.clients[c]; found {
+		s.indexID(c)
+	}
+	s.listLock.Unlock()
+
+	return c, nil
 }
 
 // ClientConnectHook sets a function to be called when a client connects to this stream's
 // HTTP handler.
-// Only one handler may be registered. Further calls overwrite the previous.
+// This replaces any previously registered connect hooks. Use AddClientConnectHook
+// to register several.
+// Passing nil removes all connect hooks.
 func (s *Stream) ClientConnectHook(fn func(*http.Request, *Client)) {
-	s.clientConnectHook = fn
+	s.clientConnectHooks = nil
+	if fn != nil {
+		s.clientConnectHooks = append(s.clientConnectHooks, fn)
+	}
+}
+
+// SetConnectAuthorizer sets a function to be called for each request to this
+// stream's HTTP handlers before a client is created for it.
+// If the function returns an error, the request is rejected with 403 Forbidden
+// and the client is never created or registered. Unlike the connect hooks,
+// which run once the client is registered and its response has started, this
+// may be used for authentication or quota checks.
+// Passing nil removes the authorizer.
+func (s *Stream) SetConnectAuthorizer(fn func(*http.Request) error) {
+	s.authorizer = fn
+}
+
+// AddClientConnectHook adds a function to be called when a client connects to
+// this stream's HTTP handler.
+// Hooks are called synchronously in the order they were added, before the
+// handler starts waiting on the client, so they may send initial events.
+func (s *Stream) AddClientConnectHook(fn func(*http.Request, *Client)) {
+	s.clientConnectHooks = append(s.clientConnectHooks, fn)
+}
+
+// RequireAcceptHeader sets whether this stream's HTTP handlers require
+// requests to carry an Accept header that allows text/event-stream.
+// Requests failing the check are rejected with 406 Not Acceptable.
+// The check is enabled by default, and may be disabled for trusted clients
+// such as scripts that do not set the header.
+func (s *Stream) RequireAcceptHeader(require bool) {
+	s.skipAcceptCheck = !require
+}
+
+// SetFactory sets a default factory used to create the events sent by the
+// stream's convenience methods, such as BroadcastString. Using an
+// EventIDFactory gives every such event a sequential ID.
+// Passing nil removes the factory.
+func (s *Stream) SetFactory(f EventFactory) {
+	s.factory = f
+}
+
+// Creates a new event with the stream's factory if set
+func (s *Stream) newEvent() *Event {
+	if s.factory != nil {
+		return s.factory.New()
+	}
+	return &Event{}
+}
+
+// EnableGzip makes this stream's HTTP handlers compress responses with gzip
+// for clients that accept it. See NewClientGzip.
+func (s *Stream) EnableGzip() {
+	s.gzip = true
+}
+
+// SetMaxClients limits the number of clients this stream's HTTP handlers will
+// accept. Further connections are rejected with 503 Service Unavailable
+// until clients disconnect. Clients registered directly count towards the
+// limit, but are never rejected.
+// A limit of 0 means unlimited.
+func (s *Stream) SetMaxClients(n int) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	s.maxClients = n
+}
+
+// Reserves a slot for a new client, if the stream is running and the limit
+// allows it
+func (s *Stream) reserve() error {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	if s.shutdown {
+		return ErrStreamShutdown
+	}
+	if s.maxClients > 0 && len(s.clients)+s.reserved >= s.maxClients {
+		return ErrTooManyClients
+	}
+	s.reserved++
+	return nil
+}
+
+// Releases a slot reserved for a client that could not be created
+func (s *Stream) release() {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	s.reserved--
+}
+
+// SetWriterWrapper sets a function to wrap the response writer of every client
+// connecting to this stream's HTTP handlers, see NewClientWrapped.
+// Passing nil removes the wrapper.
+func (s *Stream) SetWriterWrapper(wrap func(io.Writer) io.Writer) {
+	s.wrap = wrap
+}
+
+// SetHeaders sets extra headers to be sent on every response from this
+// stream's HTTP handler, for example "X-Accel-Buffering: no" to stop nginx
+// buffering the stream.
+// Headers required for the event stream itself can not be overridden.
+// Further calls overwrite the previous headers.
+func (s *Stream) SetHeaders(h http.Header) {
+	s.headers = h.Clone()
+}
+
+// SetProxyFriendly sets whether responses from this stream's HTTP handlers
+// carry headers that stop common proxies and CDNs from buffering or
+// transforming the stream: "Cache-Control: no-cache, no-transform" and
+// "X-Accel-Buffering: no". Headers already set, by SetHeaders or middleware,
+// are not overridden.
+func (s *Stream) SetProxyFriendly(enabled bool) {
+	s.proxyFriendly = enabled
+}
+
+// SetInitialEvent sets an event to be sent to every client as soon as it
+// connects to this stream's HTTP handler, before any events it missed, any
+// broadcast, or any event sent by the connect hooks.
+// The event is copied, so later changes to it have no effect.
+// Passing nil removes the initial event.
+func (s *Stream) SetInitialEvent(e *Event) {
+	s.initialEvent = nil
+	if e != nil {
+		s.initialEvent = e.share()
+	}
+}
+
+// SetRetry sets a retry directive to be sent to every client as soon as it
+// connects to this stream's HTTP handler, ahead of the initial event.
+// The duration is sent in milliseconds. Passing 0 disables the directive.
+func (s *Stream) SetRetry(d time.Duration) {
+	s.retryEvent = nil
+	if d > 0 {
+		s.retryEvent = (&Event{}).Retry(uint64(d / time.Millisecond)).share()
+	}
+}
+
+// SetAdaptiveRetry sets retry directives to send to connecting clients in
+// place of the one from SetRetry, depending on the stream's load. Clients are
+// sent the degraded duration while the stream is degraded, so they reconnect
+// less often, and the healthy duration otherwise.
+// See SetDegraded and SetDegradedClients. Passing 0 for both disables adaptive
+// retries.
+func (s *Stream) SetAdaptiveRetry(healthy, degraded time.Duration) {
+	s.healthyRetry, s.degradedRetry = nil, nil
+	if healthy > 0 {
+		s.healthyRetry = (&Event{}).Retry(uint64(healthy / time.Millisecond)).share()
+	}
+	if degraded > 0 {
+		s.degradedRetry = (&Event{}).Retry(uint64(degraded / time.Millisecond)).share()
+	}
+}
+
+// SetDegraded marks the stream as degraded or healthy for adaptive retries.
+// It is safe to call at any time from any goroutine.
+func (s *Stream) SetDegraded(degraded bool) {
+	var flag int32
+	if degraded {
+		flag = 1
+	}
+	atomic.StoreInt32(&s.degraded, flag)
+}
+
+// SetDegradedClients sets a number of clients above which the stream is
+// considered degraded for adaptive retries, even if not marked with
+// SetDegraded. A number of 0 disables this, which is the default.
+func (s *Stream) SetDegradedClients(n int) {
+	s.degradedClients = n
+}
+
+// Picks the retry directive for a connecting client
+func (s *Stream) retryFor() *Event {
+	if s.healthyRetry == nil && s.degradedRetry == nil {
+		return s.retryEvent
+	}
+
+	degraded := atomic.LoadInt32(&s.degraded) == 1
+	if !degraded && s.degradedClients > 0 {
+		degraded = s.NumClients() > s.degradedClients
+	}
+
+	if degraded {
+		return s.degradedRetry
+	}
+	return s.healthyRetry
+}
+
+// ClientDisconnectHook sets a function to be called when a client connected
+// through this stream's HTTP handler disconnects or is shutdown.
+// The hook is called after the client has been removed from the stream, with
+// the same request that was passed to the connect hook.
+// Only one handler may be registered. Further calls overwrite the previous.
+func (s *Stream) ClientDisconnectHook(fn func(*http.Request, *Client)) {
+	s.clientDisconnectHook = fn
+}
+
+// A single event being sent to some of the stream's clients
+type delivery struct {
+	stream *Stream
+	event  *Event
+	sent   int
+	err    error
+}
+
+// Starts delivering an event to the stream's clients, counting it with
+// counter if given. The event is prepared once to be shared by every client,
+// copying it first unless the stream owns it.
+// Returns nil if there is nothing to send, because the event is nil or larger
+// than the stream allows.
+func (s *Stream) deliver(e *Event, owned bool, counter *uint64) *delivery {
+	if e == nil {
+		return nil
+	}
+	if counter != nil {
+		atomic.AddUint64(counter, 1)
+	}
+
+	if !owned {
+		e = e.Clone()
+	}
+	shared := s.adopt(e)
+	if shared == nil {
+		return nil
+	}
+	return &delivery{stream: s, event: shared}
+}
+
+// Queues the event for a client
+func (d *delivery) to(cli *Client) {
+	d.result(cli, cli.send(d.event))
+}
+
+// Queues the event for a client under a key, see Client.SendLatest
+func (d *delivery) latest(cli *Client, key string) {
+	d.result(cli, cli.sendLatest(key, d.event))
+}
+
+// Records the result of queueing the event for a client, counting and
+// reporting it as dropped if the client would not accept it
+func (d *delivery) result(cli *Client, err error) {
+	if err != nil {
+		atomic.AddUint64(&d.stream.counters.dropped, 1)
+		tryPushError(d.stream.errors, cli, err)
+		if d.err == nil {
+			d.err = err
+		}
+		return
+	}
+	d.sent++
+}
+
+// Clients returns a snapshot of the clients currently registered on this stream
+func (s *Stream) Clients() []*Client {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+
+	clients := make([]*Client, 0, len(s.clients))
+	for cli := range s.clients {
+		clients = append(clients, cli)
+	}
+	return clients
+}
+
+// Range calls fn for each client registered on this stream with the topics
+// it is subscribed to, stopping if fn returns false.
+// fn is called on a snapshot taken when Range starts, without holding any
+// lock, so it may call back into the stream.
+func (s *Stream) Range(fn func(*Client, []string) bool) {
+	type entry struct {
+		client *Client
+		topics []string
+	}
+
+	s.listLock.RLock()
+	entries := make([]entry, 0, len(s.clients))
+	for cli, topics := range s.clients {
+		e := entry{client: cli}
+		for topic, active := range topics {
+			if active {
+				e.topics = append(e.topics, topic)
+			}
+		}
+		sort.Strings(e.topics)
+		entries = append(entries, e)
+	}
+	s.listLock.RUnlock()
+
+	for _, e := range entries {
+		if !fn(e.client, e.topics) {
+			return
+		}
+	}
+}
+
+// LastEventIDParam sets a query parameter to read the last event id from when a
+// request has no Last-Event-ID header, for clients that cannot set headers.
+// An empty name disables the fallback, which is the default.
+func (s *Stream) LastEventIDParam(name string) {
+	s.lastIDParam = name
+}
+
+// Gets the id of the last event a connecting client received, preferring the
+// Last-Event-ID header
+func (s *Stream) lastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	if s.lastIDParam != "" {
+		return r.URL.Query().Get(s.lastIDParam)
+	}
+	return ""
+}
+
+// AutoID sets whether events sent to clients through the stream without an id
+// are assigned one. Ids are sequential numbers, starting at 1. Only the copy
+// of the event sent to clients is given the id, the caller's event is
+// unchanged. This allows clients to resume with the Last-Event-ID header
+// without every sender having to set ids.
+func (s *Stream) AutoID(enabled bool) {
+	s.autoID = enabled
+}
+
+// Prepares an event owned by the stream to be shared between its clients in
+// place, assigning it an id if enabled.
+// Returns nil if the event is larger than the stream allows.
+func (s *Stream) adopt(e *Event) *Event {
+	// raw events have no fields to add an id to
+	if s.autoID && e.id == "" && !e.raw {
+		e.id = strconv.FormatUint(atomic.AddUint64(&s.counters.lastID, 1), 10)
+		e.bufSet = false
+	}
+	// events already prepared may be raw, so are sent as they are
+	if s.compact && !e.bufSet {
+		e.compact = true
+	}
+	if !e.bufSet {
+		e.prepare()
+	}
+
+	if s.oversized(e) {
+		return nil
+	}
+	return e
+}
+
+// SetMaxEventBytes limits the size of events sent through the stream, in the
+// wire format. Larger events are not sent to any client, and ErrEventTooLarge
+// is pushed to the Errors channel, without a client.
+// A limit of 0 means unlimited, which is the default.
+func (s *Stream) SetMaxEventBytes(n int) {
+	s.maxEventBytes = n
+}
+
+// Checks a prepared event against the size limit, reporting it if too large
+func (s *Stream) oversized(shared *Event) bool {
+	if s.maxEventBytes <= 0 || shared.Size() <= s.maxEventBytes {
+		return false
+	}
+	tryPushError(s.errors, nil, ErrEventTooLarge)
+	return true
+}
+
+// SetCompact sets whether events sent through the stream are written in the
+// compact form, without the optional space after each field's colon, see
+// Event.Compact.
+func (s *Stream) SetCompact(compact bool) {
+	s.compact = compact
+}
+
+// SetOrdered sets whether events sent through the stream are sent one at a
+// time, so every client receives them in the same order even when sent
+// concurrently. Without this, only events sent from the same goroutine are
+// guaranteed to arrive in the order they were sent.
+// Ordering makes concurrent senders wait on each other.
+func (s *Stream) SetOrdered(ordered bool) {
+	s.ordered = ordered
+}
+
+// Serializes sending an event if the stream is ordered.
+// Returns a function to call once the event has been sent.
+func (s *Stream) sequence() func() {
+	if !s.ordered {
+		return func() {}
+	}
+	s.order.Lock()
+	return s.order.Unlock
 }
 
 // NumClients returns the number of currently connected clients
 func (s *Stream) NumClients() int {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+
 	return len(s.clients)
 }
 
-// Checks that a client expects an event-stream
+// WaitForClients blocks until at least n clients are registered on this
+// stream, or the context is done. This is useful to avoid losing the first
+// events sent at startup or in tests.
+// Returns the context's error if it is done first.
+func (s *Stream) WaitForClients(ctx context.Context, n int) error {
+	for {
+		s.listLock.Lock()
+		if len(s.clients) >= n {
+			s.listLock.Unlock()
+			return nil
+		}
+		if s.joined == nil {
+			s.joined = make(chan struct{})
+		}
+		joined := s.joined
+		s.listLock.Unlock()
+
+		select {
+		case <-joined:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Wakes anything waiting for clients to join.
+// Must be called with the stream's lock held.
+func (s *Stream) signalJoined() {
+	if s.joined != nil {
+		close(s.joined)
+		s.joined = nil
+	}
+}
+
+// Checks that a client accepts an event-stream
+// The request is accepted if any of the media types listed in its Accept
+// header match text/event-stream.
 func checkRequest(r *http.Request) bool {
-	return r.Header.Get("Accept") == "text/event-stream"
+	for _, header := range r.Header.Values("Accept") {
+		for _, entry := range strings.Split(header, ",") {
+			mediaType, params, err := mime.ParseMediaType(entry)
+			if err != nil {
+				continue
+			}
+
+			// explicitly not acceptable
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+
+			switch mediaType {
+			case "text/event-stream", "text/*", "*/*":
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // try and push an error to the error channel
@@ -0,0 +1,1995 @@
+package eventsource
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// An event stream response read by a test
+type testConn struct {
+	resp   *http.Response
+	body   *bufio.Reader
+	cancel context.CancelFunc
+}
+
+// Starts a test server for the handler, closed once the test and any of its
+// streams have finished
+func serve(t *testing.T, handler http.Handler) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Opens an event stream to url, failing the test if the request fails
+func openStream(t *testing.T, url string, header http.Header) *testConn {
+	t.Helper()
+	return openStreamWith(t, http.DefaultClient, url, header)
+}
+
+// Opens an event stream to url with the given HTTP client
+func openStreamWith(t *testing.T, client *http.Client, url string, header http.Header) *testConn {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// accept an event stream unless the test sets its own Accept header, or
+	// nil to send none
+	req.Header.Set("Accept", "text/event-stream")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	return &testConn{resp: resp, body: bufio.NewReader(resp.Body), cancel: cancel}
+}
+
+// Reads the next event in wire format, including the blank line ending it
+func (tc *testConn) next(t *testing.T) string {
+	t.Helper()
+
+	var ev strings.Builder
+	for {
+		line, err := tc.body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v after %q", err, ev.String())
+		}
+		ev.WriteString(line)
+		if line == "\n" {
+			return ev.String()
+		}
+	}
+}
+
+// Closes the connection from the client side
+func (tc *testConn) close() {
+	tc.cancel()
+	tc.resp.Body.Close()
+}
+
+// Adds a connect hook to the stream reporting every client that connects
+func connections(s *Stream) <-chan *Client {
+	connected := make(chan *Client, 16)
+	s.AddClientConnectHook(func(r *http.Request, c *Client) {
+		connected <- c
+	})
+	return connected
+}
+
+// Waits for a client from a connections channel
+func waitClient(t *testing.T, connected <-chan *Client) *Client {
+	t.Helper()
+
+	select {
+	case c := <-connected:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a client to connect")
+		return nil
+	}
+}
+
+// Registers a client on the stream capturing everything written to it
+func captureClient(s *Stream) (*Client, *syncBuffer) {
+	out := &syncBuffer{}
+	c := NewClientWriter(out)
+	s.Register(c)
+	return c, out
+}
+
+// Registers n clients discarding everything written to them
+func discardClients(s *Stream, n int) []*Client {
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = NewClientWriter(ioutil.Discard)
+		s.Register(clients[i])
+	}
+	return clients
+}
+
+// Broadcast prepares the event once and shares it between every client
+func BenchmarkBroadcast1000Clients(b *testing.B) {
+	s := NewStream()
+	discardClients(s, 1000)
+	defer s.Shutdown()
+
+	e := DataEvent("a reasonably sized payload for every client")
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.Broadcast(e)
+	}
+}
+
+// Broadcasts while clients keep connecting and disconnecting. Broadcasts read
+// a snapshot of the clients, so churn never blocks them. With an event store
+// every broadcast holds the stream's lock, as all broadcasts used to, so
+// broadcasts and registrations wait on each other, and fewer registrations
+// complete per broadcast.
+func BenchmarkBroadcastChurn(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		store EventStore
+	}{
+		{"Snapshot", nil},
+		{"Locked", NewMemoryStore(1)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := NewStream()
+			discardClients(s, 1000)
+			defer s.Shutdown()
+			if bench.store != nil {
+				s.SetEventStore(bench.store)
+			}
+
+			// a client connects and disconnects every 100µs
+			churn := make([]*Client, 100)
+			for i := range churn {
+				churn[i] = NewClientWriter(ioutil.Discard)
+				defer churn[i].Shutdown()
+			}
+			stop := make(chan struct{})
+			done := make(chan int)
+			go func() {
+				registered := 0
+				defer func() { done <- registered }()
+				tick := time.NewTicker(100 * time.Microsecond)
+				defer tick.Stop()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					case <-tick.C:
+					}
+					c := churn[i%len(churn)]
+					s.Register(c)
+					s.Remove(c)
+					registered++
+				}
+			}()
+
+			e := DataEvent("a reasonably sized payload for every client")
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				s.Broadcast(e)
+			}
+
+			b.StopTimer()
+			close(stop)
+			b.ReportMetric(float64(<-done)/float64(b.N), "registers/op")
+		})
+	}
+}
+
+// Broadcasting a fresh event each time copies it once for all clients
+func BenchmarkBroadcastFresh(b *testing.B) {
+	s := NewStream()
+	discardClients(s, 10)
+	defer s.Shutdown()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		s.Broadcast((&Event{}).AppendBytes(largePayload))
+	}
+}
+
+// Broadcasting a fresh event owned by the stream saves the copy
+func BenchmarkBroadcastOwnedFresh(b *testing.B) {
+	s := NewStream()
+	discardClients(s, 10)
+	defer s.Shutdown()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		s.BroadcastOwned((&Event{}).AppendBytes(largePayload))
+	}
+}
+
+// Sending to each client copies the event for each of them, as Broadcast
+// used to
+func BenchmarkSendEach1000Clients(b *testing.B) {
+	s := NewStream()
+	clients := discardClients(s, 1000)
+	defer s.Shutdown()
+
+	e := DataEvent("a reasonably sized payload for every client")
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, c := range clients {
+			c.Send(e)
+		}
+	}
+}
+
+func TestBroadcastString(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+
+	s.BroadcastString("hello")
+	s.Shutdown()
+
+	if got, want := out.String(), "data: hello\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestBroadcastStringUsesFactory(t *testing.T) {
+	s := NewStream()
+	s.SetFactory(&EventIDFactory{Next: 1})
+	_, out := captureClient(s)
+
+	s.BroadcastString("one")
+	s.BroadcastString("two")
+	s.Shutdown()
+
+	if got, want := out.String(), "id: 1\ndata: one\n\nid: 2\ndata: two\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPublishString(t *testing.T) {
+	s := NewStream()
+	subscriber, subscribed := captureClient(s)
+	_, other := captureClient(s)
+	s.Subscribe("news", subscriber)
+
+	s.PublishString("news", "headline")
+	s.Shutdown()
+
+	if got, want := subscribed.String(), "data: headline\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if got := other.String(); got != "" {
+		t.Errorf("unsubscribed client received %q", got)
+	}
+}
+
+func TestQueryTopicHandler(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+
+	srv := serve(t, s.QueryTopicHandler("topic", nil))
+
+	conn := openStream(t, srv.URL+"?topic=news&topic=sports", nil)
+	waitClient(t, connected)
+
+	s.Publish("news", DataEvent("news"))
+	s.Publish("weather", DataEvent("weather"))
+	s.Publish("sports", DataEvent("sports"))
+	s.Broadcast(DataEvent("everyone"))
+
+	for _, want := range []string{"news", "sports", "everyone"} {
+		if got := conn.next(t); got != "data: "+want+"\n\n" {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestQueryTopicHandlerNoTopics(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+
+	srv := serve(t, s.QueryTopicHandler("topic", nil))
+
+	conn := openStream(t, srv.URL, nil)
+	waitClient(t, connected)
+
+	s.Publish("news", DataEvent("news"))
+	s.Broadcast(DataEvent("everyone"))
+
+	if got, want := conn.next(t), "data: everyone\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestQueryTopicHandlerAllowList(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+
+	srv := serve(t, s.QueryTopicHandler("topic", []string{"news", "sports"}))
+
+	conn := openStream(t, srv.URL+"?topic=news&topic=secret", nil)
+	if conn.resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want status %d, got %d", http.StatusBadRequest, conn.resp.StatusCode)
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("rejected request registered %d clients", n)
+	}
+}
+
+// Waits for a client from a disconnect hook channel
+func waitDisconnect(t *testing.T, disconnected <-chan *Client, want *Client) {
+	t.Helper()
+
+	select {
+	case c := <-disconnected:
+		if c != want {
+			t.Error("disconnect hook called with the wrong client")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the disconnect hook")
+	}
+}
+
+func TestClientDisconnectHook(t *testing.T) {
+	s := NewStream()
+	connected := connections(s)
+	disconnected := make(chan *Client, 2)
+	s.ClientDisconnectHook(func(r *http.Request, c *Client) {
+		disconnected <- c
+	})
+	srv := serve(t, s)
+
+	// the client going away
+	conn := openStream(t, srv.URL, nil)
+	c := waitClient(t, connected)
+	conn.close()
+	waitDisconnect(t, disconnected, c)
+
+	// the stream shutting down
+	conn = openStream(t, srv.URL, nil)
+	defer conn.close()
+	c = waitClient(t, connected)
+	s.Shutdown()
+	waitDisconnect(t, disconnected, c)
+}
+
+func TestShutdownContextAbandonsBlockedClient(t *testing.T) {
+	s := NewStream()
+
+	blocked := newBlockingWriter()
+	defer blocked.unblock()
+	stuck := NewClientWriter(blocked)
+	s.Register(stuck)
+	healthy, _ := captureClient(s)
+
+	stuck.Send(DataEvent("never written"))
+	<-blocked.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v despite the deadline", elapsed)
+	}
+
+	// the healthy client is still shut down in parallel
+	healthy.Wait()
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("want no clients left on the stream, got %d", n)
+	}
+}
+
+func TestShutdownContextWaitsForClients(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+	s.Broadcast(DataEvent("last"))
+
+	if err := s.ShutdownContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "data: last\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestInitialEventsSentFirst(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetRetry(1500 * time.Millisecond)
+	s.SetInitialEvent((&Event{}).Type("hello").Data("welcome"))
+	s.AddClientConnectHook(func(r *http.Request, c *Client) {
+		c.Send(DataEvent("from hook"))
+	})
+	connected := connections(s)
+
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, nil)
+	waitClient(t, connected)
+
+	for _, want := range []string{
+		"retry: 1500\n\n",
+		"event: hello\ndata: welcome\n\n",
+		"data: from hook\n\n",
+	} {
+		if got := conn.next(t); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+// An event store that holds up replaying to a connecting client, while it is
+// already registered, until released
+type gateStore struct {
+	reached chan struct{}
+	release chan struct{}
+}
+
+func (g *gateStore) Append(*Event) {}
+
+func (g *gateStore) Since(string) []*Event {
+	close(g.reached)
+	<-g.release
+	return nil
+}
+
+func TestInitialEventsSentBeforeBroadcasts(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetRetry(time.Second)
+	s.SetInitialEvent(DataEvent("welcome"))
+	gate := &gateStore{reached: make(chan struct{}), release: make(chan struct{})}
+	s.SetEventStore(gate)
+
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, http.Header{"Last-Event-Id": {"0"}})
+
+	// broadcast the moment the client is visible to broadcasts
+	<-gate.reached
+	s.BroadcastFunc(DataEvent("tick"), func(*Client) bool { return true })
+	close(gate.release)
+
+	for _, want := range []string{"retry: 1000\n\n", "data: welcome\n\n", "data: tick\n\n"} {
+		if got := conn.next(t); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestInitialEventsSentBeforeReplay(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetEventStore(NewMemoryStore(10))
+	s.SetInitialEvent(DataEvent("welcome"))
+	s.Broadcast((&Event{}).ID("1").Data("one"))
+	s.Broadcast((&Event{}).ID("2").Data("two"))
+
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, http.Header{"Last-Event-Id": {"1"}})
+
+	for _, want := range []string{"data: welcome\n\n", "id: 2\ndata: two\n\n"} {
+		if got := conn.next(t); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+// An EventStore recording what it is asked for
+type fakeStore struct {
+	lock    sync.Mutex
+	events  []*Event
+	queried []string
+}
+
+func (f *fakeStore) Append(e *Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.events = append(f.events, e)
+}
+
+func (f *fakeStore) Since(lastID string) []*Event {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.queried = append(f.queried, lastID)
+	for i, e := range f.events {
+		if e.GetID() == lastID {
+			return append([]*Event(nil), f.events[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func TestReplayFromStore(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	store := &fakeStore{}
+	s.SetEventStore(store)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		s.Broadcast((&Event{}).ID(id).Data("event " + id))
+	}
+
+	connected := connections(s)
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, http.Header{"Last-Event-Id": {"2"}})
+	waitClient(t, connected)
+	s.Broadcast((&Event{}).ID("5").Data("event 5"))
+
+	// missed events oldest first, then live ones
+	for _, id := range []string{"3", "4", "5"} {
+		want := "id: " + id + "\ndata: event " + id + "\n\n"
+		if got := conn.next(t); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if len(store.events) != 5 {
+		t.Errorf("want 5 events appended, got %d", len(store.events))
+	}
+	for i, e := range store.events {
+		if want := strconv.Itoa(i + 1); e.GetID() != want {
+			t.Errorf("event %d: want id %q, got %q", i, want, e.GetID())
+		}
+	}
+	if !reflect.DeepEqual(store.queried, []string{"2"}) {
+		t.Errorf("want the store queried for %q, got %q", "2", store.queried)
+	}
+}
+
+func TestReplayStatsCountEachEvent(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetEventStore(&fakeStore{})
+	for _, id := range []string{"1", "2", "3", "4"} {
+		s.Broadcast((&Event{}).ID(id).Data("event " + id))
+	}
+
+	connected := connections(s)
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, http.Header{"Last-Event-Id": {"1"}})
+	c := waitClient(t, connected)
+	for i := 0; i < 3; i++ {
+		conn.next(t)
+	}
+	c.Shutdown()
+
+	// the replayed events are written together, but each is counted
+	if events, _ := c.Stats(); events != 3 {
+		t.Errorf("want 3 events, got %d", events)
+	}
+}
+
+func TestSetEventStoreDuringBroadcast(t *testing.T) {
+	s := NewStream()
+	discardClients(s, 2)
+	defer s.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Broadcast(DataEvent("event"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			s.SetEventStore(NewMemoryStore(10))
+		} else {
+			s.SetEventStore(nil)
+		}
+	}
+	<-done
+}
+
+// An example domain type rendering itself as an event
+type priceUpdate struct {
+	Symbol string
+	Price  float64
+}
+
+func (p priceUpdate) MarshalEvent() (*Event, error) {
+	if p.Symbol == "" {
+		return nil, errors.New("price update without a symbol")
+	}
+	e := (&Event{}).Type("price")
+	if err := e.WriteJSON(p); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func TestBroadcastMarshal(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+
+	if err := s.BroadcastMarshal(priceUpdate{Symbol: "ABC", Price: 1.5}); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+
+	if got, want := out.String(), "event: price\ndata: {\"Symbol\":\"ABC\",\"Price\":1.5}\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPublishMarshal(t *testing.T) {
+	s := NewStream()
+	c, out := captureClient(s)
+	s.Subscribe("prices", c)
+
+	if err := s.PublishMarshal("prices", priceUpdate{Symbol: "XYZ", Price: 2}); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+
+	if got, want := out.String(), "event: price\ndata: {\"Symbol\":\"XYZ\",\"Price\":2}\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestMarshalErrorSendsNothing(t *testing.T) {
+	s := NewStream()
+	c, out := captureClient(s)
+	s.Subscribe("prices", c)
+
+	if err := s.BroadcastMarshal(priceUpdate{}); err == nil {
+		t.Error("BroadcastMarshal: want the marshal error")
+	}
+	if err := s.PublishMarshal("prices", priceUpdate{}); err == nil {
+		t.Error("PublishMarshal: want the marshal error")
+	}
+	s.Shutdown()
+
+	if got := out.String(); got != "" {
+		t.Errorf("failed marshal sent %q", got)
+	}
+	if stats := s.Stats(); stats.EventsBroadcast != 0 || stats.EventsPublished != 0 {
+		t.Errorf("failed marshal counted as sent: %+v", stats)
+	}
+}
+
+func TestBroadcastFunc(t *testing.T) {
+	s := NewStream()
+	acme, acmeOut := captureClient(s)
+	acme.Set("tenant", "acme")
+	other, otherOut := captureClient(s)
+	other.Set("tenant", "other")
+
+	s.BroadcastFunc(DataEvent("for acme"), func(c *Client) bool {
+		tenant, _ := c.Get("tenant")
+		return tenant == "acme"
+	})
+	s.Shutdown()
+
+	if got, want := acmeOut.String(), "data: for acme\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if got := otherOut.String(); got != "" {
+		t.Errorf("filtered out client received %q", got)
+	}
+}
+
+func TestFanOutCountsDropped(t *testing.T) {
+	s := NewStream()
+	c, _ := captureClient(s)
+	s.Subscribe("news", c)
+	c.Shutdown()
+
+	s.Broadcast(DataEvent("broadcast"))
+	s.BroadcastFunc(DataEvent("filtered"), func(*Client) bool { return true })
+	s.BroadcastRaw([]byte("data: raw\n\n"))
+	s.Publish("news", DataEvent("published"))
+	s.PublishMulti([]string{"news"}, DataEvent("multi"))
+	s.PublishLatest("news", DataEvent("latest"))
+
+	if got := s.Stats().EventsDropped; got != 6 {
+		t.Errorf("want 6 dropped events, got %d", got)
+	}
+}
+
+func TestHTTP2Stream(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	conn := openStreamWith(t, srv.Client(), srv.URL, nil)
+	if conn.resp.ProtoMajor != 2 {
+		t.Fatalf("want an HTTP/2 response, got %s", conn.resp.Proto)
+	}
+	if conn.resp.StatusCode != http.StatusOK {
+		t.Fatalf("want status %d, got %d", http.StatusOK, conn.resp.StatusCode)
+	}
+	if got := conn.resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("want an event stream, got content type %q", got)
+	}
+	if got := conn.resp.Header.Get("Connection"); got != "" {
+		t.Errorf("connection specific header sent over HTTP/2: %q", got)
+	}
+
+	waitClient(t, connected)
+	s.Broadcast(DataEvent("over h2"))
+	if got, want := conn.next(t), "data: over h2\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// the request context detects the client going away
+	conn.close()
+	waitForClients(t, s, 0)
+}
+
+func TestHTTP1KeepAliveHeader(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, nil)
+	if got := conn.resp.Header.Get("Connection"); got != "keep-alive" {
+		t.Errorf("want Connection: keep-alive over HTTP/1.1, got %q", got)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetHeaders(http.Header{
+		"X-Accel-Buffering":           {"no"},
+		"Access-Control-Allow-Origin": {"https://example.com"},
+		"Content-Type":                {"text/plain"},
+	})
+
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, nil)
+
+	for key, want := range map[string]string{
+		"X-Accel-Buffering":           "no",
+		"Access-Control-Allow-Origin": "https://example.com",
+		"Content-Type":                "text/event-stream",
+	} {
+		if got := conn.resp.Header.Get(key); got != want {
+			t.Errorf("%s: want %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestSetProxyFriendly(t *testing.T) {
+	for _, tc := range []struct {
+		enabled   bool
+		headers   http.Header
+		cache     string
+		buffering string
+	}{
+		{false, nil, "no-cache", ""},
+		{true, nil, "no-cache, no-transform", "no"},
+		// headers already set are kept
+		{true, http.Header{"X-Accel-Buffering": {"yes"}}, "no-cache, no-transform", "yes"},
+		{true, http.Header{"Cache-Control": {"no-cache, private"}}, "no-cache, private", "no"},
+	} {
+		s := NewStream()
+		s.SetProxyFriendly(tc.enabled)
+		if tc.headers != nil {
+			s.SetHeaders(tc.headers)
+		}
+		srv := serve(t, s)
+		conn := openStream(t, srv.URL, nil)
+
+		if got := conn.resp.Header.Get("Cache-Control"); got != tc.cache {
+			t.Errorf("%v %v: want Cache-Control %q, got %q", tc.enabled, tc.headers, tc.cache, got)
+		}
+		if got := conn.resp.Header.Get("X-Accel-Buffering"); got != tc.buffering {
+			t.Errorf("%v %v: want X-Accel-Buffering %q, got %q", tc.enabled, tc.headers, tc.buffering, got)
+		}
+		conn.cancel()
+		s.Shutdown()
+	}
+}
+
+func TestSetCompact(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetCompact(true)
+	c, out := captureClient(s)
+
+	s.Broadcast(DataEvent("hi").ID("1"))
+	c.Flush()
+	if got, want := out.String(), "id:1\ndata:hi\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStreamNilEvent(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	c, out := captureClient(s)
+	s.Subscribe("topic", c)
+
+	s.Broadcast(nil)
+	s.BroadcastOwned(nil)
+	s.Publish("topic", nil)
+	s.PublishLatest("topic", nil)
+	if n := s.BroadcastCount(nil); n != 0 {
+		t.Errorf("BroadcastCount: want 0, got %d", n)
+	}
+	if n := s.Emit(nil, "topic"); n != 0 {
+		t.Errorf("Emit: want 0, got %d", n)
+	}
+	if err := s.SendTo("a", nil); err != ErrNilEvent {
+		t.Errorf("SendTo: want %v, got %v", ErrNilEvent, err)
+	}
+
+	c.Flush()
+	if got := out.String(); got != "" {
+		t.Errorf("want nothing sent, got %q", got)
+	}
+	if stats := s.Stats(); stats.EventsBroadcast != 0 || stats.EventsPublished != 0 {
+		t.Errorf("want nil events not counted, got %+v", stats)
+	}
+}
+
+func TestSetHeadersCopied(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	headers := http.Header{"X-Custom": {"original"}}
+	s.SetHeaders(headers)
+	headers.Set("X-Custom", "changed")
+
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, nil)
+	if got := conn.resp.Header.Get("X-Custom"); got != "original" {
+		t.Errorf("want %q, got %q", "original", got)
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	for _, tc := range []struct {
+		accept []string
+		ok     bool
+	}{
+		{[]string{"text/event-stream"}, true},
+		{[]string{"text/event-stream, */*"}, true},
+		{[]string{"text/event-stream; charset=utf-8"}, true},
+		{[]string{"application/json, text/event-stream;q=0.9"}, true},
+		{[]string{"application/json", "text/event-stream"}, true},
+		{[]string{"*/*"}, true},
+		{[]string{"text/*"}, true},
+		{[]string{"application/json"}, false},
+		{[]string{"text/html, application/xml"}, false},
+		{[]string{"text/event-stream;q=0"}, false},
+		{[]string{"text/event-stream;q=0, application/json"}, false},
+		{nil, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, value := range tc.accept {
+			r.Header.Add("Accept", value)
+		}
+		if got := checkRequest(r); got != tc.ok {
+			t.Errorf("Accept %q: want %v, got %v", tc.accept, tc.ok, got)
+		}
+	}
+}
+
+func TestCompoundAcceptHeader(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	srv := serve(t, s)
+
+	conn := openStream(t, srv.URL, http.Header{"Accept": {"text/event-stream, */*"}})
+	if conn.resp.StatusCode != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, conn.resp.StatusCode)
+	}
+}
+
+func TestWrongAcceptHeader(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	srv := serve(t, s)
+
+	conn := openStream(t, srv.URL, http.Header{"Accept": {"application/json"}})
+	if conn.resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("want status %d, got %d", http.StatusNotAcceptable, conn.resp.StatusCode)
+	}
+}
+
+func TestRequireAcceptHeader(t *testing.T) {
+	for _, require := range []bool{true, false} {
+		s := NewStream()
+		s.RequireAcceptHeader(require)
+		srv := serve(t, s.TopicHandler([]string{"news"}))
+
+		conn := openStream(t, srv.URL, http.Header{"Accept": nil})
+		want := http.StatusOK
+		if require {
+			want = http.StatusNotAcceptable
+		}
+		if conn.resp.StatusCode != want {
+			t.Errorf("require %v: want status %d, got %d", require, want, conn.resp.StatusCode)
+		}
+		s.Shutdown()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+
+	upgraded := make(chan *Client, 1)
+	srv := serve(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := s.Upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		select {
+		case hooked := <-connected:
+			if hooked != c {
+				t.Error("connect hook called with the wrong client")
+			}
+		default:
+			t.Error("connect hooks not run before Upgrade returned")
+		}
+		upgraded <- c
+		c.Wait()
+		s.Remove(c)
+	}))
+
+	conn := openStream(t, srv.URL, nil)
+	defer conn.close()
+	waitClient(t, upgraded)
+
+	// the client is registered for broadcasts
+	s.Broadcast(DataEvent("hello"))
+	if got := conn.next(t); got != "data: hello\n\n" {
+		t.Errorf("want broadcast event, got %q", got)
+	}
+}
+
+func TestUpgradeWrongAcceptHeader(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	c, err := s.Upgrade(rec, req)
+	if err != ErrNotAcceptable {
+		t.Errorf("want ErrNotAcceptable, got %v", err)
+	}
+	if c != nil {
+		t.Error("want no client for a rejected request")
+	}
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("want status %d, got %d", http.StatusNotAcceptable, rec.Code)
+	}
+}
+
+func TestBroadcastWith(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+
+	s.BroadcastWith(&EventIDFactory{Next: 7}, func(e *Event) {
+		e.Type("update").Data("hello")
+	})
+	s.Shutdown()
+
+	if got, want := out.String(), "id: 7\nevent: update\ndata: hello\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestBroadcastWithStreamFactory(t *testing.T) {
+	s := NewStream()
+	s.SetFactory(&EventIDFactory{Next: 1})
+	_, out := captureClient(s)
+
+	s.BroadcastWith(nil, func(e *Event) {
+		e.Data("one")
+	})
+	s.BroadcastWith(nil, nil)
+	s.Shutdown()
+
+	if got, want := out.String(), "id: 1\ndata: one\n\nid: 2\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestUnsubscribeAll(t *testing.T) {
+	s := NewStream()
+	c, out := captureClient(s)
+	s.Subscribe("news", c)
+	s.Subscribe("sports", c)
+
+	s.UnsubscribeAll(c)
+	s.Publish("news", DataEvent("news"))
+	s.Publish("sports", DataEvent("sports"))
+	s.Broadcast(DataEvent("broadcast"))
+
+	s.Subscribe("sports", c)
+	s.Publish("news", DataEvent("news again"))
+	s.Publish("sports", DataEvent("sports again"))
+	s.Shutdown()
+
+	if got, want := out.String(), "data: broadcast\n\ndata: sports again\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestUnsubscribeAllUnregistered(t *testing.T) {
+	s := NewStream()
+	c := NewClientWriter(ioutil.Discard)
+	defer c.Shutdown()
+
+	s.UnsubscribeAll(c)
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("unsubscribing registered the client, %d clients", n)
+	}
+}
+
+func TestPublishMultiOnce(t *testing.T) {
+	s := NewStream()
+	both, bothOut := captureClient(s)
+	s.Subscribe("news", both)
+	s.Subscribe("sports", both)
+	one, oneOut := captureClient(s)
+	s.Subscribe("sports", one)
+	_, noneOut := captureClient(s)
+
+	s.PublishMulti([]string{"news", "sports", "weather"}, DataEvent("multi"))
+	s.Shutdown()
+
+	for name, out := range map[string]*syncBuffer{"both": bothOut, "one": oneOut} {
+		if got, want := out.String(), "data: multi\n\n"; got != want {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+	if got := noneOut.String(); got != "" {
+		t.Errorf("unsubscribed client received %q", got)
+	}
+	if got := s.Stats().EventsPublished; got != 1 {
+		t.Errorf("want 1 publication counted, got %d", got)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	const max = 3
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetMaxClients(max)
+	connected := connections(s)
+	srv := serve(t, s)
+
+	conns := make([]*testConn, max)
+	for i := range conns {
+		conns[i] = openStream(t, srv.URL, nil)
+		if conns[i].resp.StatusCode != http.StatusOK {
+			t.Fatalf("connection %d: want status %d, got %d", i, http.StatusOK, conns[i].resp.StatusCode)
+		}
+		waitClient(t, connected)
+	}
+
+	rejected := openStream(t, srv.URL, nil)
+	if rejected.resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want status %d over the limit, got %d", http.StatusServiceUnavailable, rejected.resp.StatusCode)
+	}
+
+	// a slot frees up once a client disconnects
+	conns[0].close()
+	waitForClients(t, s, max-1)
+	if conn := openStream(t, srv.URL, nil); conn.resp.StatusCode != http.StatusOK {
+		t.Errorf("want status %d after a disconnect, got %d", http.StatusOK, conn.resp.StatusCode)
+	}
+}
+
+func TestMaxClientsConcurrent(t *testing.T) {
+	const max, attempts = 3, 12
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetMaxClients(max)
+	srv := serve(t, s)
+
+	statuses := make(chan int, attempts)
+	for i := 0; i < attempts; i++ {
+		go func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+			req.Header.Set("Accept", "text/event-stream")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				statuses <- 0
+				cancel()
+				return
+			}
+			t.Cleanup(func() {
+				cancel()
+				resp.Body.Close()
+			})
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	accepted := 0
+	for i := 0; i < attempts; i++ {
+		switch status := <-statuses; status {
+		case http.StatusOK:
+			accepted++
+		case http.StatusServiceUnavailable:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if accepted != max {
+		t.Errorf("want %d connections accepted, got %d", max, accepted)
+	}
+}
+
+// Waits until the stream has exactly n clients
+func waitForClients(t *testing.T, s *Stream, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.NumClients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d clients, have %d", n, s.NumClients())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteTimeoutRemovesStalledClient(t *testing.T) {
+	s := NewStream()
+	s.AddClientConnectHook(func(r *http.Request, c *Client) {
+		c.SetWriteTimeout(100 * time.Millisecond)
+	})
+	connected := connections(s)
+	srv := serve(t, s)
+
+	// a raw connection that sends its request and never reads a byte
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nAccept: text/event-stream\r\n\r\n")
+	c := waitClient(t, connected)
+
+	// fill the socket buffers until the writes stall
+	payload := strings.Repeat("x", 64*1024)
+	for i := 0; i < 1000; i++ {
+		if err := c.Send(DataEvent(payload)); err != nil {
+			if err != ErrWriteTimeout {
+				t.Fatalf("want %v, got %v", ErrWriteTimeout, err)
+			}
+			break
+		}
+	}
+
+	// the handler only returns once the worker has stopped
+	waitForClients(t, s, 0)
+	waitDone(t, c)
+}
+
+func TestWriteDeadlineRemovesStuckClient(t *testing.T) {
+	s := NewStream()
+	s.AddClientConnectHook(func(r *http.Request, c *Client) {
+		c.SetWriteDeadline(100 * time.Millisecond)
+	})
+	connected := connections(s)
+	srv := serve(t, s)
+
+	// a raw connection that sends its request and never reads a byte
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nAccept: text/event-stream\r\n\r\n")
+	c := waitClient(t, connected)
+
+	// fill the socket buffers until a write hits the deadline through the
+	// response controller
+	payload := strings.Repeat("x", 64*1024)
+	for i := 0; i < 1000; i++ {
+		if c.Send(DataEvent(payload)) != nil {
+			break
+		}
+	}
+
+	waitForClients(t, s, 0)
+	waitDone(t, c)
+}
+
+func TestBroadcastRawExactBytes(t *testing.T) {
+	s := NewStream()
+	_, out1 := captureClient(s)
+	_, out2 := captureClient(s)
+
+	// not quite canonical wire format, so any re-encoding would show
+	raw := []byte("id:7\r\nevent:  spaced\r\ndata:no space\r\n: comment\r\n\r\n")
+	s.BroadcastRaw(raw)
+	copy(raw, "overwritten")
+	s.Shutdown()
+
+	want := "id:7\r\nevent:  spaced\r\ndata:no space\r\n: comment\r\n\r\n"
+	for i, out := range []*syncBuffer{out1, out2} {
+		if got := out.String(); got != want {
+			t.Errorf("client %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+
+	upstream := ": welcome\r\n" +
+		"id: 1\r\nevent: greeting\r\ndata: hello\r\ndata: world\r\n\r\n" +
+		"retry: 500\n\n" +
+		"data: last\n\n" +
+		"data: incomplete"
+	if err := s.Relay(context.Background(), strings.NewReader(upstream)); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+
+	want := "id: 1\nevent: greeting\ndata: hello\ndata: world\n\n" +
+		"retry: 500\n\n" +
+		"data: last\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRelayStopsOnCancel(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Relay(ctx, r)
+	}()
+
+	io.WriteString(w, "data: first\n\n")
+	// closing the reader with the context unblocks the pending read
+	cancel()
+	w.CloseWithError(context.Canceled)
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("want %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop")
+	}
+	s.Shutdown()
+
+	if got, want := out.String(), "data: first\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRelayReadError(t *testing.T) {
+	s := NewStream()
+	errUpstream := errors.New("upstream gone")
+
+	r := io.MultiReader(strings.NewReader("data: partial\n"), iotest.ErrReader(errUpstream))
+	if err := s.Relay(context.Background(), r); err != errUpstream {
+		t.Errorf("want %v, got %v", errUpstream, err)
+	}
+}
+
+func TestConnectAuthorizer(t *testing.T) {
+	s := NewStream()
+	errDenied := errors.New("missing token")
+	s.SetConnectAuthorizer(func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			return errDenied
+		}
+		return nil
+	})
+	connected := connections(s)
+	srv := serve(t, s)
+
+	rejected := openStream(t, srv.URL, nil)
+	if rejected.resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want status %d, got %d", http.StatusForbidden, rejected.resp.StatusCode)
+	}
+	if body, _ := ioutil.ReadAll(rejected.body); !strings.Contains(string(body), errDenied.Error()) {
+		t.Errorf("want the error in the body, got %q", body)
+	}
+	select {
+	case <-connected:
+		t.Error("connect hook called for a rejected client")
+	default:
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("want no clients registered, got %d", n)
+	}
+
+	accepted := openStream(t, srv.URL, http.Header{"Authorization": {"Bearer token"}})
+	if accepted.resp.StatusCode != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, accepted.resp.StatusCode)
+	}
+	waitClient(t, connected)
+	if n := s.NumClients(); n != 1 {
+		t.Errorf("want 1 client registered, got %d", n)
+	}
+}
+
+func TestWaitForClients(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WaitForClients(context.Background(), 2)
+	}()
+
+	discardClients(s, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("returned with 1 of 2 clients: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// the second client connects over HTTP
+	srv := serve(t, s)
+	openStream(t, srv.URL, nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("want nil, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter never unblocked")
+	}
+
+	// already satisfied
+	if err := s.WaitForClients(context.Background(), 2); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+}
+
+func TestWaitForClientsContext(t *testing.T) {
+	s := NewStream()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForClients(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestContentLengthRemoved(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+
+	// middleware that wrongly sizes every response
+	srv := serve(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		s.ServeHTTP(w, r)
+	}))
+	conn := openStream(t, srv.URL, nil)
+	waitClient(t, connected)
+
+	if conn.resp.ContentLength != -1 {
+		t.Errorf("want no content length, got %d", conn.resp.ContentLength)
+	}
+	if got := conn.resp.TransferEncoding; len(got) != 1 || got[0] != "chunked" {
+		t.Errorf("want chunked transfer encoding, got %q", got)
+	}
+
+	s.Broadcast(DataEvent("longer than five bytes"))
+	if got, want := conn.next(t), "data: longer than five bytes\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestAutoID(t *testing.T) {
+	s := NewStream()
+	s.AutoID(true)
+	store := &fakeStore{}
+	s.SetEventStore(store)
+	c, out := captureClient(s)
+	s.Subscribe("news", c)
+
+	first := DataEvent("first")
+	s.Broadcast(first)
+	s.Broadcast(DataEvent("named").ID("custom"))
+	s.Broadcast(DataEvent("second"))
+	s.Publish("news", DataEvent("published"))
+	s.Shutdown()
+
+	want := "id: 1\ndata: first\n\n" +
+		"id: custom\ndata: named\n\n" +
+		"id: 2\ndata: second\n\n" +
+		"id: 3\ndata: published\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if id := first.GetID(); id != "" {
+		t.Errorf("caller's event given id %q", id)
+	}
+
+	// the store is given the id too, so clients can resume from it
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var ids []string
+	for _, e := range store.events {
+		ids = append(ids, e.GetID())
+	}
+	if want := []string{"1", "custom", "2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("want stored ids %q, got %q", want, ids)
+	}
+}
+
+func TestAutoIDDisabled(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+
+	s.Broadcast(DataEvent("no id"))
+	s.Shutdown()
+
+	if got, want := out.String(), "data: no id\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestBroadcastCount(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+
+	if n := s.BroadcastCount(DataEvent("nobody")); n != 0 {
+		t.Errorf("want 0 with no clients, got %d", n)
+	}
+
+	clients := discardClients(s, 3)
+	if n := s.BroadcastCount(DataEvent("everyone")); n != 3 {
+		t.Errorf("want 3, got %d", n)
+	}
+
+	// still registered, but no longer accepting events
+	clients[1].Shutdown()
+	if n := s.BroadcastCount(DataEvent("two left")); n != 2 {
+		t.Errorf("want 2, got %d", n)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+
+	plain, plainOut := captureClient(s)
+	subscribed, subscribedOut := captureClient(s)
+	s.Subscribe("a", subscribed)
+	s.Subscribe("b", subscribed)
+
+	// subscribed to both topics, but still sent the event only once
+	if n := s.Emit(DataEvent("hi"), "a", "b"); n != 2 {
+		t.Errorf("want 2 clients, got %d", n)
+	}
+	plain.Flush()
+	subscribed.Flush()
+	for _, out := range []*syncBuffer{plainOut, subscribedOut} {
+		if got, want := out.String(), "data: hi\n\n"; got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	stats := s.Stats()
+	if stats.EventsBroadcast != 1 || stats.EventsPublished != 1 {
+		t.Errorf("want one broadcast and one publication, got %+v", stats)
+	}
+
+	// without topics it is only a broadcast
+	s.Emit(DataEvent("again"))
+	if got := s.Stats().EventsPublished; got != 1 {
+		t.Errorf("want still one publication, got %d", got)
+	}
+}
+
+func TestClientAge(t *testing.T) {
+	before := time.Now()
+	c := NewClientWriter(&syncBuffer{})
+	defer c.Shutdown()
+
+	if at := c.ConnectedAt(); at.Before(before) || at.After(time.Now()) {
+		t.Errorf("want connected between %v and now, got %v", before, at)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if age := c.Age(); age < 5*time.Millisecond {
+		t.Errorf("want an age of at least 5ms, got %v", age)
+	}
+}
+
+func TestThrashWindow(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+
+	// disabled by default
+	c, _ := captureClient(s)
+	s.Remove(c)
+	if got := s.Stats().ClientsThrashed; got != 0 {
+		t.Errorf("want no thrashing counted by default, got %d", got)
+	}
+
+	s.SetThrashWindow(time.Hour)
+	c, _ = captureClient(s)
+	s.Remove(c)
+	if got := s.Stats().ClientsThrashed; got != 1 {
+		t.Errorf("want 1 client thrashed, got %d", got)
+	}
+
+	// clients older than the window are not counted
+	s.SetThrashWindow(time.Millisecond)
+	c, _ = captureClient(s)
+	time.Sleep(5 * time.Millisecond)
+	s.Remove(c)
+	if got := s.Stats().ClientsThrashed; got != 1 {
+		t.Errorf("want still 1 client thrashed, got %d", got)
+	}
+
+	// nor are those removed by shutting the stream down
+	s.SetThrashWindow(time.Hour)
+	captureClient(s)
+	s.Shutdown()
+	if got := s.Stats().ClientsThrashed; got != 1 {
+		t.Errorf("want still 1 client thrashed after shutdown, got %d", got)
+	}
+}
+
+func TestLastEventIDParam(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetEventStore(NewMemoryStore(10))
+	for _, id := range []string{"1", "2", "3"} {
+		s.Broadcast((&Event{}).ID(id).Data("event " + id))
+	}
+	connected := connections(s)
+	srv := serve(t, s)
+
+	// disabled until a parameter is set
+	conn := openStream(t, srv.URL+"?lastEventId=1", nil)
+	waitClient(t, connected)
+	s.BroadcastFunc(DataEvent("live"), func(*Client) bool { return true })
+	if got, want := conn.next(t), "data: live\n\n"; got != want {
+		t.Errorf("without the parameter: want %q, got %q", want, got)
+	}
+
+	s.LastEventIDParam("lastEventId")
+	for _, tc := range []struct {
+		name   string
+		url    string
+		header http.Header
+		want   string
+	}{
+		{"query", "?lastEventId=1", nil, "id: 2\ndata: event 2\n\n"},
+		{"header preferred", "?lastEventId=1", http.Header{"Last-Event-Id": {"2"}}, "id: 3\ndata: event 3\n\n"},
+	} {
+		conn := openStream(t, srv.URL+tc.url, tc.header)
+		if got := conn.next(t); got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestRejectedAfterShutdown(t *testing.T) {
+	s := NewStream()
+	srv := serve(t, s)
+	s.Shutdown()
+
+	conn := openStream(t, srv.URL, nil)
+	if conn.resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want status %d, got %d", http.StatusServiceUnavailable, conn.resp.StatusCode)
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("want no clients, got %d", n)
+	}
+}
+
+func TestTopicHandlerRejectedAfterShutdown(t *testing.T) {
+	s := NewStream()
+	srv := serve(t, s.TopicHandler([]string{"news"}))
+	s.Shutdown()
+
+	conn := openStream(t, srv.URL, nil)
+	if conn.resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want status %d, got %d", http.StatusServiceUnavailable, conn.resp.StatusCode)
+	}
+}
+
+func TestRegisterAfterShutdown(t *testing.T) {
+	s := NewStream()
+	s.Shutdown()
+
+	c := NewClientWriter(ioutil.Discard)
+	s.Register(c)
+
+	// the client is closed rather than left running with nothing to stop it
+	waitDone(t, c)
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("want no clients, got %d", n)
+	}
+	if err := c.Send(DataEvent("late")); err != ErrClientClosed {
+		t.Errorf("want %v, got %v", ErrClientClosed, err)
+	}
+}
+
+func TestBroadcastChannel(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	connected := connections(s)
+	srv := serve(t, s)
+	conn := openStream(t, srv.URL, nil)
+	waitClient(t, connected)
+
+	ch := make(chan *Event)
+	s.BroadcastChannel(context.Background(), ch)
+	for i := 0; i < 10; i++ {
+		ch <- DataEvent(strconv.Itoa(i))
+	}
+	close(ch)
+
+	for i := 0; i < 10; i++ {
+		if got, want := conn.next(t), "data: "+strconv.Itoa(i)+"\n\n"; got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestBroadcastChannelCancel(t *testing.T) {
+	s := NewStream()
+	_, out := captureClient(s)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan *Event)
+	s.BroadcastChannel(ctx, ch)
+
+	ch <- DataEvent("before")
+	waitOutput(t, out, "data: before\n\n")
+	cancel()
+
+	// the goroutine may still take an event, but never broadcasts it
+	select {
+	case ch <- DataEvent("after"):
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.Shutdown()
+
+	if got, want := out.String(), "data: before\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCloseTopicWith(t *testing.T) {
+	s := NewStream()
+	a, outA := captureClient(s)
+	b, outB := captureClient(s)
+	other, outOther := captureClient(s)
+	s.Subscribe("news", a)
+	s.Subscribe("news", b)
+	s.Subscribe("other", other)
+
+	s.Publish("news", DataEvent("story"))
+	s.CloseTopicWith("news", DataEvent("closing"))
+	s.Publish("news", DataEvent("too late"))
+	s.Publish("other", DataEvent("unaffected"))
+	s.Shutdown()
+
+	for name, out := range map[string]*syncBuffer{"a": outA, "b": outB} {
+		if got, want := out.String(), "data: story\n\ndata: closing\n\n"; got != want {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+	if got, want := outOther.String(), "data: unaffected\n\n"; got != want {
+		t.Errorf("other topic: want %q, got %q", want, got)
+	}
+}
+
+func TestCloseTopicWithConcurrentPublish(t *testing.T) {
+	s := NewStream()
+	var outs []*syncBuffer
+	for i := 0; i < 3; i++ {
+		c, out := captureClient(s)
+		s.Subscribe("news", c)
+		outs = append(outs, out)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.Publish("news", DataEvent("story"))
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	s.CloseTopicWith("news", DataEvent("closing"))
+	close(stop)
+	<-done
+	s.Shutdown()
+
+	// the final event is always the last of the topic
+	for i, out := range outs {
+		if got := out.String(); !strings.HasSuffix(got, "data: closing\n\n") {
+			t.Errorf("client %d: want the final event last, got %d bytes", i, len(got))
+		}
+	}
+}
+
+func TestAdaptiveRetry(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetRetry(5 * time.Second)
+	s.SetAdaptiveRetry(time.Second, 30*time.Second)
+	connected := connections(s)
+	srv := serve(t, s)
+
+	connect := func() string {
+		conn := openStream(t, srv.URL, nil)
+		waitClient(t, connected)
+		return conn.next(t)
+	}
+
+	if got, want := connect(), "retry: 1000\n\n"; got != want {
+		t.Errorf("healthy: want %q, got %q", want, got)
+	}
+	s.SetDegraded(true)
+	if got, want := connect(), "retry: 30000\n\n"; got != want {
+		t.Errorf("degraded: want %q, got %q", want, got)
+	}
+	s.SetDegraded(false)
+
+	// two clients are connected, which is over the limit
+	s.SetDegradedClients(1)
+	if got, want := connect(), "retry: 30000\n\n"; got != want {
+		t.Errorf("over the client limit: want %q, got %q", want, got)
+	}
+
+	// the plain retry is used again once adaptive retries are disabled
+	s.SetAdaptiveRetry(0, 0)
+	if got, want := connect(), "retry: 5000\n\n"; got != want {
+		t.Errorf("disabled: want %q, got %q", want, got)
+	}
+}
+
+func TestMaxEventBytes(t *testing.T) {
+	s := NewStream()
+	errs := s.Errors(10)
+	c, out := captureClient(s)
+	s.Subscribe("news", c)
+
+	// exactly at the limit, counting both data prefixes
+	atLimit := DataEvent("12\n34")
+	s.SetMaxEventBytes(atLimit.Size())
+
+	s.Broadcast(atLimit)
+	s.Broadcast(DataEvent("12\n345"))
+	s.Publish("news", DataEvent("12\n3\n4"))
+	s.Shutdown()
+
+	if got, want := out.String(), "data: 12\ndata: 34\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err.Err != ErrEventTooLarge || err.Client != nil {
+				t.Errorf("want %v without a client, got %v for %p", ErrEventTooLarge, err.Err, err.Client)
+			}
+		default:
+			t.Fatalf("want 2 errors, got %d", i)
+		}
+	}
+}
+
+func TestOrderedConsistentAcrossClients(t *testing.T) {
+	s := NewStream()
+	s.SetOrdered(true)
+	var outs []*syncBuffer
+	for i := 0; i < 5; i++ {
+		c, out := captureClient(s)
+		s.Subscribe("news", c)
+		outs = append(outs, out)
+	}
+
+	var wg sync.WaitGroup
+	for sender := 0; sender < 4; sender++ {
+		sender := sender
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				data := strconv.Itoa(sender) + "-" + strconv.Itoa(i)
+				if i%2 == 0 {
+					s.Broadcast(DataEvent(data))
+				} else {
+					s.Publish("news", DataEvent(data))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	s.Shutdown()
+
+	want := outs[0].String()
+	if n := strings.Count(want, "\n\n"); n != 400 {
+		t.Fatalf("want 400 events, got %d", n)
+	}
+	for i, out := range outs[1:] {
+		if out.String() != want {
+			t.Errorf("client %d saw a different order to client 0", i+1)
+		}
+	}
+}
+
+func TestOrderedCloseTopicWith(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	s.SetOrdered(true)
+	clients := make([]*Client, 10)
+	outs := make([]*syncBuffer, 10)
+	for i := range clients {
+		clients[i], outs[i] = captureClient(s)
+		s.Subscribe("news", clients[i])
+	}
+
+	// a client with a full queue holds up the broadcast part way through
+	// its clients
+	w := newBlockingWriter()
+	blocked := NewClientWriter(w)
+	s.Register(blocked)
+	blocked.Send(DataEvent("stuck"))
+	<-w.started
+	blocked.Send(DataEvent("queued"))
+
+	done := make(chan struct{}, 2)
+	go func() {
+		s.Broadcast(DataEvent("broadcast"))
+		done <- struct{}{}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		s.CloseTopicWith("news", DataEvent("final"))
+		done <- struct{}{}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	w.unblock()
+	<-done
+	<-done
+
+	// the final event must not overtake the broadcast for any client
+	for i, c := range clients {
+		c.Flush()
+		if got, want := outs[i].String(), "data: broadcast\n\ndata: final\n\n"; got != want {
+			t.Errorf("client %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestTransferTo(t *testing.T) {
+	from, to := NewStream(), NewStream()
+	c, out := captureClient(from)
+	from.Subscribe("news", c)
+
+	from.Broadcast(DataEvent("before"))
+	if err := from.TransferTo(to); err != nil {
+		t.Fatal(err)
+	}
+	from.Broadcast(DataEvent("old stream"))
+	to.Broadcast(DataEvent("after"))
+	to.Publish("news", DataEvent("topic kept"))
+
+	if n := from.NumClients(); n != 0 {
+		t.Errorf("want the old stream empty, got %d clients", n)
+	}
+	if n := to.NumClients(); n != 1 {
+		t.Errorf("want 1 client on the new stream, got %d", n)
+	}
+	to.Shutdown()
+
+	if got, want := out.String(), "data: before\n\ndata: after\n\ndata: topic kept\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestTransferToShutdown(t *testing.T) {
+	from, to := NewStream(), NewStream()
+	defer from.Shutdown()
+	discardClients(from, 2)
+	to.Shutdown()
+
+	if err := from.TransferTo(to); err != ErrStreamShutdown {
+		t.Errorf("want %v, got %v", ErrStreamShutdown, err)
+	}
+	if n := from.NumClients(); n != 2 {
+		t.Errorf("want the clients left in place, got %d", n)
+	}
+}
+
+func TestTransferToTwiceRemovesFromEach(t *testing.T) {
+	a, b, c := NewStream(), NewStream(), NewStream()
+	defer b.Shutdown()
+	defer c.Shutdown()
+	connected := connections(a)
+	srv := serve(t, a)
+
+	// the first client moves to b, and the second, connecting later, to c
+	first := openStream(t, srv.URL, nil)
+	waitClient(t, connected)
+	if err := a.TransferTo(b); err != nil {
+		t.Fatal(err)
+	}
+	second := openStream(t, srv.URL, nil)
+	waitClient(t, connected)
+	if err := a.TransferTo(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// each is removed from the stream it was moved to when it disconnects
+	first.close()
+	waitForClients(t, b, 0)
+	second.close()
+	waitForClients(t, c, 0)
+}
+
+func TestTransferToChained(t *testing.T) {
+	a, b, c := NewStream(), NewStream(), NewStream()
+	defer c.Shutdown()
+	connected := connections(a)
+	srv := serve(t, a)
+
+	conn := openStream(t, srv.URL, nil)
+	waitClient(t, connected)
+	a.TransferTo(b)
+	b.TransferTo(c)
+
+	conn.close()
+	waitForClients(t, c, 0)
+}
@@ -0,0 +1,103 @@
+package eventsource
+
+import (
+	"strings"
+	"sync"
+)
+
+// EnableWildcards turns on wildcard matching of topic subscriptions.
+// Topics are treated as dot separated segments, such as "orders.eu.created".
+// A subscription segment of "*" matches exactly one segment, except as the
+// final segment where it matches all remaining segments. A segment of "**"
+// matches one or more segments wherever it is, so "orders.**.created"
+// matches "orders.eu.created" and "orders.eu.uk.created" but not
+// "orders.eu.shipped". At least one segment must remain for either to match,
+// so "orders.*" matches "orders.eu" and "orders.eu.created" but not "orders".
+// Exact matching is the default as wildcard matching must check every
+// subscription a client has on each publish.
+func (s *Stream) EnableWildcards() {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+
+	s.wildcards = true
+}
+
+// Checks if a client's topics match a published topic
+func (s *Stream) subscribed(topics topicList, topic string) bool {
+	if topics[topic] {
+		return true
+	}
+	if !s.wildcards {
+		return false
+	}
+
+	for pattern, active := range topics {
+		if active && matchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches a topic against a subscription pattern that may contain wildcards
+func matchTopic(pattern, topic string) bool {
+	return matchSegments(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+// Matches topic segments against pattern segments
+func matchSegments(patterns, segments []string) bool {
+	for i, p := range patterns {
+		if i >= len(segments) {
+			return false
+		}
+
+		last := i == len(patterns)-1
+		switch {
+		case p == "**" && !last:
+			// try every number of segments for the wildcard to match,
+			// leaving at least one for the rest of the pattern
+			for next := i + 1; next < len(segments); next++ {
+				if matchSegments(patterns[i+1:], segments[next:]) {
+					return true
+				}
+			}
+			return false
+		case p == "**", p == "*" && last:
+			return true
+		case p == "*":
+			continue
+		case p != segments[i]:
+			return false
+		}
+	}
+
+	return len(patterns) == len(segments)
+}
+
+// Subscription is a client's subscription to a topic, returned by
+// Stream.Subscribe
+type Subscription struct {
+	stream *Stream
+	topic  string
+	client *Client
+	once   sync.Once
+}
+
+// Topic returns the topic subscribed to
+func (sub *Subscription) Topic() string {
+	return sub.topic
+}
+
+// Client returns the subscribed client
+func (sub *Subscription) Client() *Client {
+	return sub.client
+}
+
+// Cancel unsubscribes the client from the topic, in the same way as
+// Stream.Unsubscribe. It is safe to call more than once, and after the client
+// has been removed from the stream.
+func (sub *Subscription) Cancel() {
+	sub.once.Do(func() {
+		sub.stream.Unsubscribe(sub.topic, sub.client)
+	})
+}
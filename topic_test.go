@@ -0,0 +1,215 @@
+package eventsource
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"orders.eu.created", "orders.eu.created", true},
+		{"orders.eu.created", "orders.eu.shipped", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.us.created", true},
+		{"orders.*.created", "orders.eu.shipped", false},
+		{"orders.*.created", "orders.eu.created.late", false},
+		{"orders.eu.*", "orders.eu.created", true},
+		{"orders.eu.*", "orders.us.created", false},
+		{"orders.**", "orders.eu.created.late", true},
+		{"orders.**", "orders", false},
+		{"*.eu.*", "orders.eu.created", true},
+		{"*.eu.*", "users.eu.joined.today", true},
+		{"*.eu.*", "orders.us.created", false},
+		{"**", "anything.at.all", true},
+		// a multi-level wildcard in the middle still matches what follows it
+		{"a.**.c", "a.b.c", true},
+		{"a.**.c", "a.b.b.c", true},
+		{"a.**.c", "a.c", false},
+		{"a.**.c", "a.b.d", false},
+		{"a.**.c", "a.b.c.d", false},
+		{"orders.**.created", "orders.eu.shipped", false},
+		{"a.**.c.*", "a.b.c.d.e", true},
+		{"a.**.b.**.c", "a.x.b.y.z.c", true},
+		{"a.**.b.**.c", "a.x.y.c", false},
+		{"orders", "orders.eu", false},
+		{"orders.eu", "orders", false},
+	} {
+		if got := matchTopic(tc.pattern, tc.topic); got != tc.match {
+			t.Errorf("%q against %q: want %v, got %v", tc.pattern, tc.topic, tc.match, got)
+		}
+	}
+}
+
+func TestPublishWildcards(t *testing.T) {
+	s := NewStream()
+	s.EnableWildcards()
+	all, allOut := captureClient(s)
+	s.Subscribe("orders.*", all)
+	eu, euOut := captureClient(s)
+	s.Subscribe("orders.eu.*", eu)
+	created, createdOut := captureClient(s)
+	s.Subscribe("orders.*.created", created)
+
+	s.Publish("orders.eu.created", DataEvent("eu created"))
+	s.Publish("orders.us.shipped", DataEvent("us shipped"))
+	s.Publish("orders.us.created", DataEvent("us created"))
+	s.Publish("users.eu.joined", DataEvent("user"))
+	s.Shutdown()
+
+	for _, tc := range []struct {
+		name string
+		out  *syncBuffer
+		want string
+	}{
+		{"orders.*", allOut, "data: eu created\n\ndata: us shipped\n\ndata: us created\n\n"},
+		{"orders.eu.*", euOut, "data: eu created\n\n"},
+		{"orders.*.created", createdOut, "data: eu created\n\ndata: us created\n\n"},
+	} {
+		if got := tc.out.String(); got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestPublishExactByDefault(t *testing.T) {
+	s := NewStream()
+	c, out := captureClient(s)
+	s.Subscribe("orders.*", c)
+
+	s.Publish("orders.eu", DataEvent("concrete"))
+	s.Publish("orders.*", DataEvent("literal"))
+	s.Shutdown()
+
+	if got, want := out.String(), "data: literal\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPublishWildcardOnce(t *testing.T) {
+	s := NewStream()
+	s.EnableWildcards()
+	c, out := captureClient(s)
+	s.Subscribe("orders.*", c)
+	s.Subscribe("orders.eu.*", c)
+	s.Subscribe("orders.eu.created", c)
+
+	s.Publish("orders.eu.created", DataEvent("once"))
+	s.Shutdown()
+
+	if got, want := out.String(), "data: once\n\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSubscriptionCancel(t *testing.T) {
+	s := NewStream()
+	c, out := captureClient(s)
+	news := s.Subscribe("news", c)
+	s.Subscribe("sport", c)
+
+	if news.Topic() != "news" || news.Client() != c {
+		t.Errorf("want a handle for news and the client, got %q and %p", news.Topic(), news.Client())
+	}
+
+	s.Publish("news", DataEvent("before"))
+	news.Cancel()
+	s.Publish("news", DataEvent("after"))
+	s.Publish("sport", DataEvent("unaffected"))
+
+	// cancelling again doesn't remove a newer subscription
+	s.Subscribe("news", c)
+	news.Cancel()
+	s.Publish("news", DataEvent("resubscribed"))
+	s.Shutdown()
+
+	want := "data: before\n\ndata: unaffected\n\ndata: resubscribed\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSubscriptionCancelAfterDisconnect(t *testing.T) {
+	s := NewStream()
+	c, _ := captureClient(s)
+	sub := s.Subscribe("news", c)
+
+	s.Remove(c)
+	c.Shutdown()
+	sub.Cancel()
+	sub.Cancel()
+
+	// the client is not brought back by cancelling
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("want no clients, got %d", n)
+	}
+	s.Publish("news", DataEvent("nobody"))
+}
+
+func TestPathTopicHandler(t *testing.T) {
+	for _, tc := range []struct {
+		path  string
+		topic string
+	}{
+		{"/events/orders", "orders"},
+		{"/events/orders/", "orders"},
+		{"/events/a%2Fb", "a/b"},
+		{"/events/caf%C3%A9", "café"},
+		{"/events/", ""},
+		{"/events", ""},
+	} {
+		s := NewStream()
+		connected := connections(s)
+		srv := serve(t, s.PathTopicHandler("/events"))
+		conn := openStream(t, srv.URL+tc.path, nil)
+		waitClient(t, connected)
+
+		// a subscribed client gets the publication ahead of the broadcast
+		want := "data: broadcast\n\n"
+		if tc.topic != "" {
+			s.Publish(tc.topic, DataEvent("published"))
+			want = "data: published\n\n"
+		}
+		s.Publish("unrelated", DataEvent("unrelated"))
+		s.Broadcast(DataEvent("broadcast"))
+
+		if got := conn.next(t); got != want {
+			t.Errorf("%s: want %q, got %q", tc.path, want, got)
+		}
+		s.Shutdown()
+	}
+}
+
+func TestPathTopicHandlerOutsidePrefix(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	srv := serve(t, s.PathTopicHandler("/events/"))
+
+	if conn := openStream(t, srv.URL+"/other/orders", nil); conn.resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want status %d, got %d", http.StatusNotFound, conn.resp.StatusCode)
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("want no clients, got %d", n)
+	}
+}
+
+func TestPathTopicHandlerSegmentBoundary(t *testing.T) {
+	s := NewStream()
+	defer s.Shutdown()
+	srv := serve(t, s.PathTopicHandler("/events"))
+
+	// the prefix is only part of the first segment
+	for _, path := range []string{"/eventsorders", "/events-old/orders"} {
+		if conn := openStream(t, srv.URL+path, nil); conn.resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: want status %d, got %d", path, http.StatusNotFound, conn.resp.StatusCode)
+		}
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Errorf("want no clients, got %d", n)
+	}
+}